@@ -0,0 +1,115 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus-community/pushprox/util"
+)
+
+var (
+	auditFile       = kingpin.Flag("audit.file", "File to write a JSON lines log of executed scrape requests to. Disabled if empty.").String()
+	auditMaxSize    = kingpin.Flag("audit.max-size", "Size after which the audit log is rotated.").Default("10MB").Bytes()
+	auditMaxBackups = kingpin.Flag("audit.max-backups", "Number of rotated audit logs to keep.").Default("3").Int()
+)
+
+var (
+	auditDroppedCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pushprox_client_audit_entries_dropped_total",
+			Help: "Number of audit log entries which could not be written",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(auditDroppedCounter)
+}
+
+// Whether a scrape request was executed.
+const (
+	auditAllowed = "allowed"
+	auditDenied  = "denied"
+)
+
+// auditEntry is a single line of the audit log.
+type auditEntry struct {
+	Timestamp time.Time           `json:"timestamp"`
+	ScrapeID  string              `json:"scrape_id"`
+	Method    string              `json:"method"`
+	URL       string              `json:"url"`
+	Headers   map[string][]string `json:"headers"`
+	Decision  string              `json:"decision"`
+	Status    int                 `json:"status,omitempty"`
+	Bytes     int64               `json:"bytes"`
+	Duration  float64             `json:"duration_seconds"`
+	Error     string              `json:"error,omitempty"`
+}
+
+// newAuditLogFromFlags returns the configured audit log, or nil if disabled.
+func newAuditLogFromFlags(logger *slog.Logger) (*util.AuditLog, error) {
+	if *auditFile == "" {
+		return nil, nil
+	}
+	f, err := util.NewRotatingFile(*auditFile, int64(*auditMaxSize), *auditMaxBackups)
+	if err != nil {
+		return nil, err
+	}
+	return util.NewAuditLog(f, auditDroppedCounter, logger), nil
+}
+
+// redactHeaders returns a copy of h with credentials replaced.
+func redactHeaders(h http.Header) map[string][]string {
+	redacted := make(map[string][]string, len(h))
+	for k, v := range h {
+		if isSecretHeader(k) {
+			v = []string{"<redacted>"}
+		}
+		redacted[k] = v
+	}
+	return redacted
+}
+
+func isSecretHeader(name string) bool {
+	name = strings.ToLower(name)
+	switch name {
+	case "authorization", "proxy-authorization", "cookie":
+		return true
+	}
+	for _, s := range []string{"token", "secret", "password", "api-key", "apikey"} {
+		if strings.Contains(name, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	return n, err
+}
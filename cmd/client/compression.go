@@ -0,0 +1,64 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"net/http"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus-community/pushprox/util"
+)
+
+var pushCompression = kingpin.Flag("push.compression", "Compression of pushed scrape results, if the proxy supports it. Results the target compressed already are pushed as they are.").Default(util.EncodingGzip).Enum(util.EncodingGzip, util.EncodingZstd, "none")
+
+var (
+	compressionInputBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pushprox_client_compression_input_bytes_total",
+			Help: "Bytes of scrape results compressed before pushing, by encoding",
+		}, []string{"encoding"},
+	)
+	compressionOutputBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pushprox_client_compression_output_bytes_total",
+			Help: "Bytes of scrape results pushed after compressing them, by encoding",
+		}, []string{"encoding"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(compressionInputBytes, compressionOutputBytes)
+}
+
+// compressResult compresses the body of resp if the proxy accepts the
+// compression, unless the target compressed it already.
+func compressResult(resp *http.Response, caps util.Capabilities) error {
+	encoding := *pushCompression
+	if !util.IsSupportedEncoding(encoding) || !caps.Has(encoding) || resp.Header.Get("Content-Encoding") != "" {
+		return nil
+	}
+	body, err := util.Compress(resp.Body, encoding, func(in, out int64) {
+		compressionInputBytes.WithLabelValues(encoding).Add(float64(in))
+		compressionOutputBytes.WithLabelValues(encoding).Add(float64(out))
+	})
+	if err != nil {
+		return err
+	}
+	resp.Body = body
+	resp.Header.Set("Content-Encoding", encoding)
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	return nil
+}
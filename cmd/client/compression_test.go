@@ -0,0 +1,71 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/prometheus-community/pushprox/util"
+)
+
+func TestCompressResult(t *testing.T) {
+	*pushCompression = util.EncodingGzip
+	defer func() { *pushCompression = "" }()
+	newResult := func(encoding string) *http.Response {
+		resp := &http.Response{
+			Header:        http.Header{"Content-Length": {"5"}},
+			Body:          io.NopCloser(strings.NewReader("up 1\n")),
+			ContentLength: 5,
+		}
+		if encoding != "" {
+			resp.Header.Set("Content-Encoding", encoding)
+		}
+		return resp
+	}
+
+	resp := newResult("")
+	if err := compressResult(resp, util.Capabilities{util.CapabilityGzip: 0}); err != nil {
+		t.Fatal(err)
+	}
+	if got := resp.Header.Get("Content-Encoding"); got != util.EncodingGzip || resp.ContentLength != -1 || resp.Header.Get("Content-Length") != "" {
+		t.Fatalf("Expected a gzip result of unknown length, got %q of %d", got, resp.ContentLength)
+	}
+	body, err := util.Decompress(resp.Body, util.EncodingGzip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := io.ReadAll(body); string(b) != "up 1\n" {
+		t.Errorf("Expected the result back, got %q", b)
+	}
+
+	// The proxy doesn't accept gzip.
+	resp = newResult("")
+	if err := compressResult(resp, util.Capabilities{util.CapabilityZstd: 0}); err != nil {
+		t.Fatal(err)
+	}
+	if got := resp.Header.Get("Content-Encoding"); got != "" {
+		t.Errorf("Expected an uncompressed result, got %q", got)
+	}
+
+	// The target compressed the result already.
+	resp = newResult(util.EncodingZstd)
+	if err := compressResult(resp, util.Capabilities{util.CapabilityGzip: 0}); err != nil {
+		t.Fatal(err)
+	}
+	if got := resp.Header.Get("Content-Encoding"); got != util.EncodingZstd || resp.ContentLength != 5 {
+		t.Errorf("Expected the result as the target sent it, got %q of %d", got, resp.ContentLength)
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/prometheus-community/pushprox/pushproxpb"
+	"github.com/prometheus-community/pushprox/util"
+)
+
+// doGRPC connects to the gRPC service of the proxy and runs the scrapes
+// received, sending their results back on the same call, until it ends.
+func (c *Coordinator) doGRPC(ctx context.Context, client *http.Client) (err error) {
+	if c.noStreams.Load() {
+		return c.doPoll(ctx, client)
+	}
+	base, err := c.endpoint("")
+	if err != nil {
+		return fmt.Errorf("error parsing url: %w", err)
+	}
+	target, creds := base.Host, insecure.NewCredentials()
+	switch {
+	case base.Scheme == "https":
+		creds = credentials.NewTLS(c.tlsConfig)
+		if base.Port() == "" {
+			target = net.JoinHostPort(base.Hostname(), "443")
+		}
+	case base.Port() == "":
+		target = net.JoinHostPort(base.Hostname(), "80")
+	}
+	conn, err := grpc.NewClient(target, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return fmt.Errorf("error connecting via gRPC: %w", err)
+	}
+	defer conn.Close()
+
+	// Ends the call once we're done, failing pushes of scrapes still running.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := pushproxpb.NewPushProxClient(conn).Connect(ctx)
+	if err == nil {
+		err = stream.Send(&pushproxpb.ClientMessage{Message: &pushproxpb.ClientMessage_Hello{Hello: &pushproxpb.Hello{
+			Fqdn:        *myFqdn,
+			ScrapeLimit: int32(c.newPoll().Capabilities[util.CapabilityScrapeLimit]),
+		}}})
+	}
+	if err == nil {
+		var header metadata.MD
+		// Without a header, the proxy turned us down.
+		if header, err = stream.Header(); err == nil && header == nil {
+			_, err = stream.Recv()
+		}
+	}
+	if err != nil && ctx.Err() != nil {
+		// Shutting down.
+		return err
+	}
+	if err != nil {
+		if stream != nil {
+			if handled, err := c.followTrailer(stream.Trailer()); handled {
+				return err
+			}
+		}
+		if status.Code(err) == codes.Unimplemented {
+			c.logger.Warn("Proxy does not support gRPC, falling back to polling")
+			c.noStreams.Store(true)
+			return nil
+		}
+		c.logger.Error("Error connecting via gRPC:", "err", err)
+		c.redirect.Store(nil)
+		c.conn.pollDone(false, err)
+		return fmt.Errorf("error connecting via gRPC: %w", err)
+	}
+	c.conn.pollSent()
+	defer func() {
+		c.conn.pollDone(true, err)
+	}()
+	c.logger.Info("Connected via gRPC")
+
+	n := negotiated{version: util.ProtocolVersion, stream: &grpcResults{stream: stream}}
+	for {
+		instruction, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			c.logger.Info("gRPC stream closed by proxy")
+			return nil
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			if handled, err := c.followTrailer(stream.Trailer()); handled {
+				return err
+			}
+			return fmt.Errorf("error reading gRPC stream: %w", err)
+		}
+		request, deadline, err := util.ReadScrapeInstruction(context.Background(), instruction)
+		if err != nil {
+			return fmt.Errorf("error reading request: %w", err)
+		}
+		scrapeCtx := context.WithValue(request.Context(), negotiatedKey{}, n)
+		scrapeCtx = context.WithValue(scrapeCtx, scrapeDeadlineKey{}, deadline)
+		c.startScrape(request.WithContext(scrapeCtx), client)
+	}
+}
+
+// followTrailer follows the proxy asking us to reconnect or connect to
+// another replica when turning down a gRPC call, like followProxy.
+func (c *Coordinator) followTrailer(md metadata.MD) (bool, error) {
+	if len(md.Get(util.ReconnectMetadata)) > 0 {
+		c.logger.Info("Proxy asked to reconnect")
+		c.redirect.Store(nil)
+		return true, nil
+	}
+	if location := md.Get(util.RedirectMetadata); len(location) > 0 {
+		u, err := url.Parse(location[0])
+		if err != nil {
+			return true, fmt.Errorf("error reading redirect: %w", err)
+		}
+		return true, c.redirectTo(u.ResolveReference(&url.URL{Path: "./"}))
+	}
+	return false, nil
+}
+
+// grpcResults sends scrape results on a gRPC call.
+type grpcResults struct {
+	mu     sync.Mutex
+	stream pushproxpb.PushProx_ConnectClient
+}
+
+func (g *grpcResults) WriteResult(resp *http.Response) error {
+	result, err := util.NewScrapeResult(resp)
+	if err != nil {
+		return err
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.stream.Send(&pushproxpb.ClientMessage{Message: &pushproxpb.ClientMessage_Result{Result: result}})
+}
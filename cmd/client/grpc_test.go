@@ -0,0 +1,149 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/promslog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	"github.com/prometheus-community/pushprox/pushproxpb"
+	"github.com/prometheus-community/pushprox/util"
+)
+
+// fakeGRPCProxy sends a single scrape to a connecting client.
+type fakeGRPCProxy struct {
+	pushproxpb.UnimplementedPushProxServer
+	target string
+	pushed chan *pushproxpb.ScrapeResult
+}
+
+func (p *fakeGRPCProxy) Connect(stream pushproxpb.PushProx_ConnectServer) error {
+	msg, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	if fqdn := msg.GetHello().GetFqdn(); fqdn != *myFqdn {
+		return io.ErrUnexpectedEOF
+	}
+	err = stream.Send(&pushproxpb.ScrapeInstruction{
+		Id:      "a",
+		Method:  http.MethodGet,
+		Url:     p.target + "/metrics",
+		Timeout: durationpb.New(10 * time.Second),
+	})
+	if err != nil {
+		return err
+	}
+	msg, err = stream.Recv()
+	if err != nil {
+		return err
+	}
+	p.pushed <- msg.GetResult()
+	return nil
+}
+
+func startGRPCProxy(t *testing.T, srv pushproxpb.PushProxServer) *grpc.Server {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := grpc.NewServer()
+	if srv != nil {
+		pushproxpb.RegisterPushProxServer(s, srv)
+	}
+	go s.Serve(l)
+	*proxyURL = "http://" + l.Addr().String() + "/"
+	return s
+}
+
+func TestGRPC(t *testing.T) {
+	var timeout string
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timeout = r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds")
+		io.WriteString(w, "up 1\n")
+	}))
+	defer target.Close()
+	u, _ := url.Parse(target.URL)
+	*myFqdn = u.Hostname()
+
+	proxy := &fakeGRPCProxy{target: target.URL, pushed: make(chan *pushproxpb.ScrapeResult, 1)}
+	s := startGRPCProxy(t, proxy)
+	defer s.Stop()
+
+	c := &Coordinator{logger: promslog.NewNopLogger()}
+	if err := c.doGRPC(context.Background(), target.Client()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case result := <-proxy.pushed:
+		if result.GetId() != "a" || string(result.GetBody()) != "up 1\n" {
+			t.Errorf("Unexpected result %v", result)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the result on the gRPC stream")
+	}
+	c.scrapes.Wait()
+	if timeout != "" {
+		t.Errorf("Expected the scrape to run on the deadline sent, without a timeout header, got %q", timeout)
+	}
+}
+
+func TestGRPCFallback(t *testing.T) {
+	// A gRPC server without the PushProx service.
+	s := startGRPCProxy(t, nil)
+	defer s.Stop()
+	c := &Coordinator{logger: promslog.NewNopLogger()}
+
+	if err := c.doGRPC(context.Background(), http.DefaultClient); err != nil {
+		t.Fatal(err)
+	}
+	if !c.noStreams.Load() {
+		t.Fatal("Expected to fall back to polling")
+	}
+}
+
+// shardedGRPCProxy redirects clients to another replica.
+type shardedGRPCProxy struct {
+	pushproxpb.UnimplementedPushProxServer
+}
+
+func (shardedGRPCProxy) Connect(stream pushproxpb.PushProx_ConnectServer) error {
+	stream.SetTrailer(metadata.Pairs(util.RedirectMetadata, "http://owner.example.com:8080/"))
+	return status.Error(codes.Unavailable, "client is served by another replica")
+}
+
+func TestGRPCRedirect(t *testing.T) {
+	s := startGRPCProxy(t, shardedGRPCProxy{})
+	defer s.Stop()
+	c := &Coordinator{logger: promslog.NewNopLogger()}
+
+	if err := c.doGRPC(context.Background(), http.DefaultClient); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.redirect.Load(); got == nil || got.String() != "http://owner.example.com:8080/" {
+		t.Fatalf("Expected to be redirected to the owner, got %v", got)
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	readyMaxPollAge = kingpin.Flag("ready.max-poll-age", "The client is only ready if a poll is outstanding or the last poll succeeded within this time.").Default("5m").Duration()
+)
+
+var (
+	connectedGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "pushprox_client_connected",
+			Help: "Whether the last poll reached the proxy",
+		},
+	)
+	lastPollGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "pushprox_client_last_successful_poll_timestamp_seconds",
+			Help: "Time the last poll succeeded",
+		},
+	)
+	inFlightScrapesGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "pushprox_client_scrapes_in_flight",
+			Help: "Number of scrapes currently being executed",
+		},
+	)
+	pollDurationHistogram = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "pushprox_client_poll_duration_seconds",
+			Help:    "Round-trip time of polls, including waiting for a scrape",
+			Buckets: []float64{.01, .05, .1, .5, 1, 5, 10, 30, 60, 120, 300},
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(connectedGauge, lastPollGauge, inFlightScrapesGauge, pollDurationHistogram)
+}
+
+// connState tracks whether the client is connected to the proxy.
+type connState struct {
+	connected atomic.Bool
+	// Polls sent and waiting for a scrape.
+	pending atomic.Int64
+	// Unix nanoseconds of the last successful poll.
+	lastPoll atomic.Int64
+}
+
+// pollSent records that a poll reached the proxy.
+func (s *connState) pollSent() {
+	s.connected.Store(true)
+	s.pending.Add(1)
+	connectedGauge.Set(1)
+}
+
+// pollDone records the outcome of a poll, which reached the proxy if sent.
+func (s *connState) pollDone(sent bool, err error) {
+	if sent {
+		s.pending.Add(-1)
+	}
+	if err != nil {
+		s.connected.Store(false)
+		connectedGauge.Set(0)
+		return
+	}
+	now := time.Now()
+	s.connected.Store(true)
+	s.lastPoll.Store(now.UnixNano())
+	connectedGauge.Set(1)
+	lastPollGauge.Set(float64(now.UnixNano()) / 1e9)
+}
+
+func (s *connState) ready() bool {
+	if !s.connected.Load() {
+		return false
+	}
+	return s.pending.Load() > 0 || time.Since(time.Unix(0, s.lastPoll.Load())) < *readyMaxPollAge
+}
+
+// newMetricsHandler serves the metrics along with health and readiness.
+func (c *Coordinator) newMetricsHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/", promhttp.Handler())
+	mux.HandleFunc("/-/healthy", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "PushProx Client is Healthy.\n")
+	})
+	mux.HandleFunc("/-/ready", func(w http.ResponseWriter, r *http.Request) {
+		if !c.conn.ready() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "PushProx Client is not Ready.\n")
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "PushProx Client is Ready.\n")
+	})
+	return mux
+}
@@ -0,0 +1,131 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	maxConcurrency = kingpin.Flag("scrape.max-concurrency", "Maximum number of scrapes executed at once, 0 for no limit").Default("0").Int()
+	maxQueued      = kingpin.Flag("scrape.max-queued", "Maximum number of scrapes waiting for one of --scrape.max-concurrency to finish. Further scrapes are rejected.").Default("10").Int()
+	advertiseLimit = kingpin.Flag("scrape.advertise-limit", "Tell the proxy how many scrapes this client accepts at once, so it rejects further scrapes itself").Bool()
+)
+
+var (
+	scrapeQueueGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "pushprox_client_scrape_queue_depth",
+			Help: "Number of scrapes waiting for a free slot",
+		},
+	)
+	scrapeRejectedCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pushprox_client_scrapes_rejected_total",
+			Help: "Number of scrapes rejected because too many were in flight",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(scrapeQueueGauge, scrapeRejectedCounter)
+}
+
+// scrapeLimiter bounds the number of concurrent scrapes, queueing a bounded
+// number of further scrapes.
+type scrapeLimiter struct {
+	slots    chan struct{}
+	queued   atomic.Int64
+	maxQueue int64
+}
+
+// newScrapeLimiter returns a limiter, or nil if concurrency is not limited.
+func newScrapeLimiter(concurrency, queue int) *scrapeLimiter {
+	if concurrency <= 0 {
+		return nil
+	}
+	return &scrapeLimiter{
+		slots:    make(chan struct{}, concurrency),
+		maxQueue: int64(queue),
+	}
+}
+
+// capacity returns the number of scrapes accepted at once, or 0 if unlimited.
+func (l *scrapeLimiter) capacity() int {
+	if l == nil {
+		return 0
+	}
+	return cap(l.slots) + int(l.maxQueue)
+}
+
+// acquire waits for a free slot. It returns false if the queue is full or
+// ctx is done first.
+func (l *scrapeLimiter) acquire(ctx context.Context) bool {
+	if l == nil {
+		return true
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+	}
+	if l.queued.Add(1) > l.maxQueue {
+		l.queued.Add(-1)
+		return false
+	}
+	scrapeQueueGauge.Inc()
+	defer func() {
+		l.queued.Add(-1)
+		scrapeQueueGauge.Dec()
+	}()
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (l *scrapeLimiter) release() {
+	if l == nil {
+		return
+	}
+	<-l.slots
+}
+
+// errTooManyScrapes is pushed for scrapes rejected by the limiter.
+var errTooManyScrapes = errors.New("too many concurrent scrapes, try again later")
+
+// runScrape runs a scrape once the limiter admits it, or pushes an error.
+func (c *Coordinator) runScrape(request *http.Request, client *http.Client) {
+	// Waiting longer than the scrape timeout is pointless.
+	ctx := context.Background()
+	if timeout, err := scrapeTimeout(request); err == nil {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	if !c.limiter.acquire(ctx) {
+		scrapeRejectedCounter.Inc()
+		c.pushError(request, client, http.StatusServiceUnavailable, errTooManyScrapes)
+		return
+	}
+	defer c.limiter.release()
+	c.doScrape(request, client)
+}
@@ -0,0 +1,91 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/promslog"
+)
+
+func TestScrapeLimiter(t *testing.T) {
+	l := newScrapeLimiter(1, 1)
+	if got := l.capacity(); got != 2 {
+		t.Errorf("Expected capacity 2, got %d", got)
+	}
+	if !l.acquire(context.Background()) {
+		t.Fatal("Expected the first scrape to run")
+	}
+	queued := make(chan bool)
+	go func() { queued <- l.acquire(context.Background()) }()
+	for l.queued.Load() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	if l.acquire(context.Background()) {
+		t.Fatal("Expected a scrape beyond the queue to be rejected")
+	}
+	l.release()
+	if !<-queued {
+		t.Fatal("Expected the queued scrape to run once a slot is free")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if l.acquire(ctx) {
+		t.Fatal("Expected a queued scrape to give up once its timeout passed")
+	}
+
+	var unlimited *scrapeLimiter
+	if !unlimited.acquire(context.Background()) || unlimited.capacity() != 0 {
+		t.Error("Expected a nil limiter not to limit scrapes")
+	}
+}
+
+func TestRunScrapeRejected(t *testing.T) {
+	pushed := make(chan *http.Response, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resp, err := http.ReadResponse(bufio.NewReader(r.Body), nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		pushed <- resp
+	}))
+	defer ts.Close()
+	*proxyURL = ts.URL + "/"
+	c := &Coordinator{limiter: newScrapeLimiter(1, 0), logger: promslog.NewNopLogger()}
+	c.limiter.acquire(context.Background())
+
+	req, err := http.NewRequest("GET", "http://client.example.com/metrics", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", "10.0")
+	c.runScrape(req, ts.Client())
+
+	resp := <-pushed
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected status %d, got %d", http.StatusServiceUnavailable, resp.StatusCode)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if !strings.Contains(string(body), errTooManyScrapes.Error()) {
+		t.Errorf("Expected body to explain the rejection, got %q", body)
+	}
+}
@@ -14,7 +14,6 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
 	"context"
 	"crypto/tls"
@@ -25,19 +24,29 @@ import (
 	"log/slog"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
 	"os"
+	"os/signal"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/Showmax/go-fqdn"
 	"github.com/alecthomas/kingpin/v2"
 	"github.com/cenkalti/backoff/v4"
+	"github.com/gorilla/websocket"
 	"github.com/prometheus-community/pushprox/util"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/prometheus/common/promslog"
 	"github.com/prometheus/common/promslog/flag"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/crypto/ssh"
 )
 
 var (
@@ -50,8 +59,17 @@ var (
 
 	retryInitialWait = kingpin.Flag("proxy.retry.initial-wait", "Amount of time to wait after proxy failure").Default("1s").Duration()
 	retryMaxWait     = kingpin.Flag("proxy.retry.max-wait", "Maximum amount of time to wait between proxy poll retries").Default("5s").Duration()
+	transportMode    = kingpin.Flag("transport", "How to exchange scrapes with the proxy: poll for long polling, stream for a single HTTP/2 stream carrying all scrapes, websocket for a single WebSocket carrying all scrapes, grpc for a single gRPC call carrying all scrapes, mqtt for the topics of the client at --mqtt.broker, ssh for scrapes sent by the SSH server at --ssh.proxy-address.").Default("poll").Enum("poll", "stream", "websocket", "grpc", "mqtt", "ssh")
+	pollWorkers      = kingpin.Flag("proxy.poll-workers", "Number of polls kept outstanding at the proxy, i.e. scrapes that can be handed to the client at once").Default("1").Int()
+	shutdownTimeout  = kingpin.Flag("shutdown-timeout", "How long to wait for in-flight scrapes to finish on shutdown").Default("30s").Duration()
+
+	tracingEndpoint     = kingpin.Flag("tracing.endpoint", "OTLP/HTTP endpoint (host:port) to export traces to. Tracing is disabled if empty.").String()
+	tracingInsecure     = kingpin.Flag("tracing.insecure", "Export traces without TLS.").Bool()
+	tracingSamplingRate = kingpin.Flag("tracing.sampling-rate", "Fraction of scrapes without a sampled parent trace to trace.").Default("1").Float64()
 )
 
+var tracer = otel.Tracer("github.com/prometheus-community/pushprox/cmd/client")
+
 var (
 	scrapeErrorCounter = prometheus.NewCounter(
 		prometheus.CounterOpts{
@@ -88,14 +106,50 @@ func newBackOffFromFlags() backoff.BackOff {
 
 // Coordinator for scrape requests and responses
 type Coordinator struct {
+	// Proxy the client was redirected to, if any.
+	redirect atomic.Pointer[url.URL]
+	conn     connState
+	// In-flight scrapes.
+	scrapes sync.WaitGroup
+	limiter *scrapeLimiter
+	batcher pushBatcher
+	// Client for streams, which need HTTP/2. Falls back to polling once
+	// the proxy turns out not to support streams.
+	streamClient *http.Client
+	noStreams    atomic.Bool
+	// Dialer for WebSockets, going through the same HTTP proxy.
+	dialer *websocket.Dialer
+	// TLS configuration for gRPC.
+	tlsConfig *tls.Config
+	// Configuration for SSH.
+	sshConfig *ssh.ClientConfig
+
+	audit  *util.AuditLog
 	logger *slog.Logger
 }
 
+// endpoint returns the URL of an API endpoint of the proxy.
+func (c *Coordinator) endpoint(path string) (*url.URL, error) {
+	base := c.redirect.Load()
+	if base == nil {
+		var err error
+		if base, err = url.Parse(*proxyURL); err != nil {
+			return nil, err
+		}
+	}
+	return base.ResolveReference(&url.URL{Path: path}), nil
+}
+
 func (c *Coordinator) handleErr(request *http.Request, client *http.Client, err error) {
+	c.pushError(request, client, http.StatusInternalServerError, err)
+}
+
+// pushError reports a failed scrape to the proxy with the given status.
+func (c *Coordinator) pushError(request *http.Request, client *http.Client, status int, err error) {
 	c.logger.Error("Coordinator error", "error", err)
 	scrapeErrorCounter.Inc()
 	resp := &http.Response{
-		StatusCode: http.StatusInternalServerError,
+		StatusCode: status,
 		Body:       io.NopCloser(strings.NewReader(err.Error())),
 		Header:     http.Header{},
 	}
@@ -108,13 +162,33 @@ func (c *Coordinator) handleErr(request *http.Request, client *http.Client, err
 }
 
 func (c *Coordinator) doScrape(request *http.Request, client *http.Client) {
+	inFlightScrapesGauge.Inc()
+	defer inFlightScrapesGauge.Dec()
 	logger := c.logger.With("scrape_id", request.Header.Get("id"))
-	timeout, err := util.GetHeaderTimeout(request.Header)
+	ctx, span := tracer.Start(util.ExtractTraceContext(request.Context(), request.Header), "client scrape",
+		trace.WithAttributes(attribute.String("scrape_id", request.Header.Get("id"))))
+	defer span.End()
+	request = request.WithContext(ctx)
+	entry := auditEntry{
+		Timestamp: time.Now(),
+		ScrapeID:  request.Header.Get("id"),
+		Method:    request.Method,
+		URL:       request.URL.String(),
+		Headers:   redactHeaders(request.Header),
+		Decision:  auditAllowed,
+		Status:    http.StatusInternalServerError,
+	}
+	defer func() {
+		entry.Duration = time.Since(entry.Timestamp).Seconds()
+		c.audit.Log(entry)
+	}()
+	timeout, err := scrapeTimeout(request)
 	if err != nil {
+		entry.Error = err.Error()
 		c.handleErr(request, client, err)
 		return
 	}
-	ctx, cancel := context.WithTimeout(request.Context(), timeout)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 	request = request.WithContext(ctx)
 	// We cannot handle https requests at the proxy, as we would only
@@ -127,17 +201,36 @@ func (c *Coordinator) doScrape(request *http.Request, client *http.Client) {
 	}
 
 	if request.URL.Hostname() != *myFqdn {
-		c.handleErr(request, client, errors.New("scrape target doesn't match client fqdn"))
+		err = errors.New("scrape target doesn't match client fqdn")
+		entry.Decision = auditDenied
+		entry.Error = err.Error()
+		c.handleErr(request, client, err)
 		return
 	}
 
+	fetchCtx, fetchSpan := tracer.Start(ctx, "fetch target", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("url", request.URL.String())))
+	// Forward the trace context to the exporter.
+	util.InjectTraceContext(fetchCtx, request.Header)
 	scrapeResp, err := client.Do(request)
 	if err != nil {
-		c.handleErr(request, client, fmt.Errorf("failed to scrape %s: %w", request.URL.String(), err))
+		fetchSpan.SetStatus(codes.Error, err.Error())
+		fetchSpan.End()
+		err = fmt.Errorf("failed to scrape %s: %w", request.URL.String(), err)
+		entry.Error = err.Error()
+		c.handleErr(request, client, err)
 		return
 	}
+	fetchSpan.SetAttributes(attribute.Int("status", scrapeResp.StatusCode))
+	fetchSpan.End()
 	logger.Info("Retrieved scrape response")
+	defer scrapeResp.Body.Close()
+	body := &countingReader{ReadCloser: scrapeResp.Body}
+	scrapeResp.Body = body
+	entry.Status = scrapeResp.StatusCode
+	defer func() { entry.Bytes = body.n }()
 	if err = c.doPush(scrapeResp, request, client); err != nil {
+		entry.Error = err.Error()
 		pushErrorCounter.Inc()
 		logger.Warn("Failed to push scrape response:", "err", err)
 		return
@@ -145,98 +238,357 @@ func (c *Coordinator) doScrape(request *http.Request, client *http.Client) {
 	logger.Info("Pushed scrape result")
 }
 
+// scrapeDeadlineKey marks scrape requests received with a deadline, rather
+// than with the scrape timeout of Prometheus in their headers.
+type scrapeDeadlineKey struct{}
+
+// scrapeTimeout returns how long a scrape may take.
+func scrapeTimeout(request *http.Request) (time.Duration, error) {
+	if deadline, ok := request.Context().Value(scrapeDeadlineKey{}).(time.Time); ok {
+		return time.Until(deadline), nil
+	}
+	return util.GetHeaderTimeout(request.Header)
+}
+
 // Report the result of the scrape back up to the proxy.
-func (c *Coordinator) doPush(resp *http.Response, origRequest *http.Request, client *http.Client) error {
+func (c *Coordinator) doPush(resp *http.Response, origRequest *http.Request, client *http.Client) (err error) {
+	ctx, span := tracer.Start(origRequest.Context(), "push", trace.WithSpanKind(trace.SpanKindClient))
+	defer func() {
+		if err != nil {
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
 	resp.Header.Set("id", origRequest.Header.Get("id")) // Link the request and response
 	// Remaining scrape deadline.
 	deadline, _ := origRequest.Context().Deadline()
 	resp.Header.Set("X-Prometheus-Scrape-Timeout", fmt.Sprintf("%f", float64(time.Until(deadline))/1e9))
 
-	base, err := url.Parse(*proxyURL)
+	url, err := c.endpoint("push")
 	if err != nil {
 		return err
 	}
-	u, err := url.Parse("push")
-	if err != nil {
+
+	n := negotiatedFor(origRequest)
+	if err := compressResult(resp, n.capabilities); err != nil {
 		return err
 	}
-	url := base.ResolveReference(u)
+	if n.stream != nil {
+		return n.stream.WriteResult(resp)
+	}
+	if n.capabilities.Has(util.CapabilityBatch) {
+		msg, small, err := readSmallResult(resp)
+		if err != nil {
+			return err
+		}
+		if small {
+			return c.pushBatched(client, n, deadline, msg)
+		}
+	}
 
-	buf := &bytes.Buffer{}
-	//nolint:errcheck // https://github.com/prometheus-community/PushProx/issues/111
-	resp.Write(buf)
-	request := &http.Request{
-		Method:        "POST",
-		URL:           url,
-		Body:          io.NopCloser(buf),
-		ContentLength: int64(buf.Len()),
-	}
-	request = request.WithContext(origRequest.Context())
-	if _, err = client.Do(request); err != nil {
+	// Stream the result to the proxy as it is read from the target.
+	pr, pw := io.Pipe()
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		pw.CloseWithError(resp.Write(pw))
+	}()
+	defer func() {
+		// The proxy may answer before reading all of the result.
+		pr.Close()
+		resp.Body.Close()
+		<-written
+	}()
+	request, err := util.NewStreamedPushRequest(ctx, url.String(), n.version, pr)
+	if err != nil {
 		return err
 	}
+	util.InjectTraceContext(ctx, request.Header)
+	pushResp, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer pushResp.Body.Close()
+	if pushResp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(pushResp.Body, 1024))
+		return fmt.Errorf("unexpected status %s: %s", pushResp.Status, bytes.TrimSpace(body))
+	}
 	return nil
 }
 
-func (c *Coordinator) doPoll(client *http.Client) error {
-	base, err := url.Parse(*proxyURL)
+// maxBatchedResultSize is the largest result body pushed in a batch. Larger
+// results are streamed in a push of their own rather than held in memory.
+const maxBatchedResultSize = 64 << 10
+
+// readSmallResult serializes resp if its body is no larger than
+// maxBatchedResultSize. Otherwise it returns false, with the body of resp
+// still to be read in full.
+func readSmallResult(resp *http.Response) ([]byte, bool, error) {
+	head, err := io.ReadAll(io.LimitReader(resp.Body, maxBatchedResultSize+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if len(head) > maxBatchedResultSize {
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(head), resp.Body), resp.Body}
+		return nil, false, nil
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(head))
+	resp.ContentLength = int64(len(head))
+	resp.TransferEncoding = nil
+	buf := &bytes.Buffer{}
+	if err := resp.Write(buf); err != nil {
+		return nil, false, err
+	}
+	return buf.Bytes(), true, nil
+}
+
+func (c *Coordinator) doPoll(ctx context.Context, client *http.Client) (err error) {
+	start := time.Now()
+	var sent atomic.Bool
+	defer func() {
+		pollDurationHistogram.Observe(time.Since(start).Seconds())
+		c.conn.pollDone(sent.Load(), err)
+	}()
+	pollURL, err := c.endpoint("poll")
 	if err != nil {
 		c.logger.Error("Error parsing url:", "err", err)
 		return fmt.Errorf("error parsing url: %w", err)
 	}
-	u, err := url.Parse("poll")
+	// Redirects to another proxy replica are followed by hand, so that
+	// pushes go there too.
+	pollClient := *client
+	pollClient.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		WroteRequest: func(info httptrace.WroteRequestInfo) {
+			if info.Err == nil && !sent.Swap(true) {
+				c.conn.pollSent()
+			}
+		},
+	})
+	pollRequest, err := util.NewPollRequest(ctx, pollURL.String(), c.newPoll())
 	if err != nil {
-		c.logger.Error("Error parsing url:", "err", err)
-		return fmt.Errorf("error parsing url poll: %w", err)
+		return err
+	}
+	resp, err := pollClient.Do(pollRequest)
+	if err != nil && ctx.Err() != nil {
+		// Shutting down.
+		return err
 	}
-	url := base.ResolveReference(u)
-	resp, err := client.Post(url.String(), "", strings.NewReader(*myFqdn))
 	if err != nil {
 		c.logger.Error("Error polling:", "err", err)
+		// The replica we were redirected to may be gone.
+		c.redirect.Store(nil)
 		return fmt.Errorf("error polling: %w", err)
 	}
 	defer resp.Body.Close()
 
-	request, err := http.ReadRequest(bufio.NewReader(resp.Body))
+	if handled, err := c.followProxy(resp); handled {
+		return err
+	}
+
+	requests, err := readPollResponse(resp)
 	if err != nil {
 		c.logger.Error("Error reading request:", "err", err)
 		return fmt.Errorf("error reading request: %w", err)
 	}
-	c.logger.Info("Got scrape request", "scrape_id", request.Header.Get("id"), "url", request.URL)
+	for _, request := range requests {
+		c.startScrape(request, client)
+	}
 
-	request.RequestURI = ""
+	return nil
+}
 
-	go c.doScrape(request, client)
+// followProxy handles the proxy asking the client to reconnect or to go to
+// another replica. It returns false if the proxy did neither.
+func (c *Coordinator) followProxy(resp *http.Response) (bool, error) {
+	if resp.Header.Get(util.ReconnectHeader) != "" {
+		// The proxy is going away, poll again right away. Through the
+		// configured URL, as the proxy we were redirected to may be the one.
+		c.logger.Info("Proxy asked to reconnect")
+		c.redirect.Store(nil)
+		return true, nil
+	}
+	if resp.StatusCode == http.StatusTemporaryRedirect || resp.StatusCode == http.StatusPermanentRedirect {
+		location, err := resp.Location()
+		if err != nil {
+			return true, fmt.Errorf("error reading redirect: %w", err)
+		}
+		return true, c.redirectTo(location.ResolveReference(&url.URL{Path: "./"}))
+	}
+	return false, nil
+}
 
+// redirectTo has the client connect to another replica. A redirect from a
+// replica we were redirected to means the replicas disagree on who owns us,
+// e.g. while their view of the cluster changes, so it is returned as an error
+// to back off rather than bounce between them.
+func (c *Coordinator) redirectTo(base *url.URL) error {
+	c.logger.Info("Redirected to another proxy", "proxy_url", base.String())
+	// Other polls in flight, e.g. of other poll workers, are redirected to
+	// the same replica.
+	if prev := c.redirect.Swap(base); prev != nil && prev.String() != base.String() {
+		return fmt.Errorf("redirected again, from %s to %s", prev, base)
+	}
 	return nil
 }
 
-func (c *Coordinator) loop(bo backoff.BackOff, client *http.Client) {
-	op := func() error {
-		return c.doPoll(client)
-	}
+// startScrape runs a scrape request received from the proxy.
+func (c *Coordinator) startScrape(request *http.Request, client *http.Client) {
+	c.logger.Info("Got scrape request", "scrape_id", request.Header.Get("id"), "url", request.URL)
+
+	request.RequestURI = ""
 
-	for {
-		if err := backoff.RetryNotify(op, bo, func(err error, _ time.Duration) {
+	c.scrapes.Add(1)
+	go func() {
+		defer c.scrapes.Done()
+		c.runScrape(request, client)
+	}()
+}
+
+// loop runs op, e.g. a poll, until ctx is done.
+func (c *Coordinator) loop(ctx context.Context, bo backoff.BackOff, op func() error) {
+	for ctx.Err() == nil {
+		if err := backoff.RetryNotify(op, backoff.WithContext(bo, ctx), func(err error, _ time.Duration) {
 			pollErrorCounter.Inc()
-		}); err != nil {
+		}); err != nil && ctx.Err() == nil {
 			c.logger.Error("backoff returned error", "error", err)
 		}
 	}
 }
 
+// run polls the proxy with the given number of workers until ctx is done.
+// The proxy hands every scrape to one of the polls outstanding, so that
+// scrapes arriving together don't wait for each other's round-trips.
+func (c *Coordinator) run(ctx context.Context, workers int, client *http.Client) {
+	switch *transportMode {
+	case "stream":
+		c.loop(ctx, newBackOffFromFlags(), func() error {
+			return c.doStream(ctx, client)
+		})
+		return
+	case "websocket":
+		c.loop(ctx, newBackOffFromFlags(), func() error {
+			return c.doWebSocket(ctx, client)
+		})
+		return
+	case "grpc":
+		c.loop(ctx, newBackOffFromFlags(), func() error {
+			return c.doGRPC(ctx, client)
+		})
+		return
+	case "mqtt":
+		c.loop(ctx, newBackOffFromFlags(), func() error {
+			return c.doMQTT(ctx, client)
+		})
+		return
+	case "ssh":
+		c.loop(ctx, newBackOffFromFlags(), func() error {
+			return c.doSSH(ctx, client)
+		})
+		return
+	}
+	var wg sync.WaitGroup
+	for range max(workers, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.loop(ctx, newBackOffFromFlags(), func() error {
+				return c.doPoll(ctx, client)
+			})
+		}()
+	}
+	wg.Wait()
+}
+
+// shutdown waits for in-flight scrapes to be pushed, or ctx to be done, and
+// then tells the proxy to forget this client.
+func (c *Coordinator) shutdown(ctx context.Context, client *http.Client) error {
+	done := make(chan struct{})
+	go func() {
+		c.scrapes.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		c.logger.Warn("Not all scrapes finished before the shutdown timeout")
+	}
+
+	if *transportMode == "mqtt" {
+		// The proxy deregistered the client as it went offline.
+		return nil
+	}
+	u, err := c.endpoint("deregister")
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), strings.NewReader(*myFqdn))
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
 func main() {
 	promslogConfig := promslog.Config{}
 	flag.AddFlags(kingpin.CommandLine, &promslogConfig)
 	kingpin.HelpFlag.Short('h')
 	kingpin.Parse()
 	logger := promslog.New(&promslogConfig)
-	coordinator := Coordinator{logger: logger}
+	audit, err := newAuditLogFromFlags(logger)
+	if err != nil {
+		logger.Error("Audit log initialization failed", "err", err)
+		os.Exit(1)
+	}
+	defer audit.Close()
+	coordinator := Coordinator{
+		limiter: newScrapeLimiter(*maxConcurrency, *maxQueued),
+		audit:   audit,
+		logger:  logger,
+	}
+
+	shutdownTracing, err := util.SetupTracing(context.Background(), "pushprox-client", util.TracingConfig{
+		Endpoint:     *tracingEndpoint,
+		Insecure:     *tracingInsecure,
+		SamplingRate: *tracingSamplingRate,
+	})
+	if err != nil {
+		coordinator.logger.Error("Tracing initialization failed", "err", err)
+		os.Exit(1)
+	}
+	defer shutdownTracing(context.Background())
 
 	if *proxyURL == "" {
 		coordinator.logger.Error("--proxy-url flag must be specified.")
 		os.Exit(1)
 	}
+	if *transportMode == "mqtt" && *mqttBroker == "" {
+		coordinator.logger.Error("--mqtt.broker flag must be specified with --transport=mqtt.")
+		os.Exit(1)
+	}
+	if *transportMode == "ssh" {
+		if *sshProxyAddress == "" || *sshKey == "" || *sshKnownHosts == "" {
+			coordinator.logger.Error("--ssh.proxy-address, --ssh.key and --ssh.known-hosts flags must be specified with --transport=ssh.")
+			os.Exit(1)
+		}
+		if coordinator.sshConfig, err = newSSHConfigFromFlags(); err != nil {
+			coordinator.logger.Error("SSH initialization failed", "err", err)
+			os.Exit(1)
+		}
+	}
 	// Make sure proxyURL ends with a single '/'
 	*proxyURL = strings.TrimRight(*proxyURL, "/") + "/"
 	coordinator.logger.Info("URL and FQDN info", "proxy_url", *proxyURL, "fqdn", *myFqdn)
@@ -270,7 +622,7 @@ func main() {
 
 	if *metricsAddr != "" {
 		go func() {
-			if err := http.ListenAndServe(*metricsAddr, promhttp.Handler()); err != nil {
+			if err := http.ListenAndServe(*metricsAddr, coordinator.newMetricsHandler()); err != nil {
 				coordinator.logger.Warn("ListenAndServe", "err", err)
 			}
 		}()
@@ -288,7 +640,9 @@ func main() {
 			},
 			DualStack: true,
 		}).DialContext,
-		MaxIdleConns:          100,
+		MaxIdleConns: 100,
+		// Keep a connection for every poll worker, plus some for pushes.
+		MaxIdleConnsPerHost:   *pollWorkers + http.DefaultMaxIdleConnsPerHost,
 		IdleConnTimeout:       90 * time.Second,
 		TLSHandshakeTimeout:   10 * time.Second,
 		ExpectContinueTimeout: 1 * time.Second,
@@ -296,6 +650,27 @@ func main() {
 	}
 
 	client := &http.Client{Transport: transport}
+	streamTransport := transport.Clone()
+	streamTransport.Protocols = &http.Protocols{}
+	streamTransport.Protocols.SetHTTP2(true)
+	streamTransport.Protocols.SetUnencryptedHTTP2(true)
+	coordinator.streamClient = &http.Client{Transport: streamTransport}
+	coordinator.tlsConfig = tlsConfig
+	coordinator.dialer = &websocket.Dialer{
+		Proxy:            transport.Proxy,
+		NetDialContext:   transport.DialContext,
+		TLSClientConfig:  tlsConfig,
+		HandshakeTimeout: transport.TLSHandshakeTimeout,
+	}
 
-	coordinator.loop(newBackOffFromFlags(), client)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	coordinator.run(ctx, *pollWorkers, client)
+
+	coordinator.logger.Info("Shutting down", "timeout", *shutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	if err := coordinator.shutdown(shutdownCtx, client); err != nil {
+		coordinator.logger.Warn("Failed to deregister from proxy", "err", err)
+	}
 }
@@ -14,21 +14,36 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/prometheus/common/promslog"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/prometheus-community/pushprox/util"
 )
 
-func prepareTest() (*httptest.Server, Coordinator) {
+func prepareTest() (*httptest.Server, *Coordinator) {
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		fmt.Fprintln(w, "GET /index.html HTTP/1.0\n\nOK")
 	}))
-	c := Coordinator{logger: promslog.NewNopLogger()}
+	c := &Coordinator{logger: promslog.NewNopLogger()}
 	*proxyURL = ts.URL
 	return ts, c
 }
@@ -60,7 +75,313 @@ func TestHandleErr(t *testing.T) {
 func TestLoop(t *testing.T) {
 	ts, c := prepareTest()
 	defer ts.Close()
-	if err := c.doPoll(ts.Client()); err != nil {
+	if err := c.doPoll(context.Background(), ts.Client()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+var (
+	testSpans        = tracetest.NewInMemoryExporter()
+	setupTestTracing sync.Once
+)
+
+func TestDoScrapeTracing(t *testing.T) {
+	// The global tracer only binds to the first provider set.
+	setupTestTracing.Do(func() {
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(testSpans)))
+	})
+	testSpans.Reset()
+	if _, err := util.SetupTracing(context.Background(), "test", util.TracingConfig{}); err != nil {
+		t.Fatal(err)
+	}
+
+	var targetTraceparent string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/metrics" {
+			targetTraceparent = r.Header.Get("Traceparent")
+		}
+		fmt.Fprintln(w, "OK")
+	}))
+	defer ts.Close()
+	c := &Coordinator{logger: promslog.NewNopLogger()}
+	*proxyURL = ts.URL
+
+	// The trace as started by the proxy.
+	parentCtx, parent := otel.Tracer("test").Start(context.Background(), "proxy scrape")
+	parent.End()
+	req, err := http.NewRequest("GET", ts.URL+"/metrics", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("X-Prometheus-Scrape-Timeout-Seconds", "10.0")
+	util.InjectTraceContext(parentCtx, req.Header)
+	*myFqdn = req.URL.Hostname()
+	c.doScrape(req, ts.Client())
+
+	traceID := parent.SpanContext().TraceID()
+	names := map[string]bool{}
+	for _, span := range testSpans.GetSpans() {
+		// Scrapes started by other tests may still be running.
+		if span.SpanContext.TraceID() == traceID {
+			names[span.Name] = true
+		}
+	}
+	for _, name := range []string{"client scrape", "fetch target", "push"} {
+		if !names[name] {
+			t.Errorf("Missing span %q, got %v", name, names)
+		}
+	}
+	targetCtx := util.ExtractTraceContext(context.Background(), http.Header{"Traceparent": {targetTraceparent}})
+	if got := trace.SpanContextFromContext(targetCtx).TraceID(); got != traceID {
+		t.Errorf("Expected trace %s to be forwarded to the target, got %q", traceID, targetTraceparent)
+	}
+}
+
+func TestDoScrapeAudit(t *testing.T) {
+	ts, c := prepareTest()
+	defer ts.Close()
+	path := filepath.Join(t.TempDir(), "audit.log")
+	f, err := util.NewRotatingFile(path, 0, 0)
+	if err != nil {
 		t.Fatal(err)
 	}
+	c.audit = util.NewAuditLog(f, auditDroppedCounter, c.logger)
+
+	req, err := http.NewRequest("GET", "http://other.example.com/metrics", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("X-Prometheus-Scrape-Timeout-Seconds", "10.0")
+	req.Header.Add("Authorization", "Bearer secret")
+	*myFqdn = "client.example.com"
+	c.doScrape(req, ts.Client())
+	if err := c.audit.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entry auditEntry
+	if err := json.Unmarshal(b, &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry.Decision != auditDenied {
+		t.Errorf("Expected scrape of another host to be denied, got %q", entry.Decision)
+	}
+	if got := entry.Headers["Authorization"]; len(got) != 1 || got[0] != "<redacted>" {
+		t.Errorf("Expected Authorization header to be redacted, got %q", got)
+	}
+}
+
+func TestPollRedirect(t *testing.T) {
+	owner, c := prepareTest()
+	defer owner.Close()
+	lb := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, owner.URL+"/poll", http.StatusTemporaryRedirect)
+	}))
+	defer lb.Close()
+	*proxyURL = lb.URL + "/"
+
+	if err := c.doPoll(context.Background(), lb.Client()); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := c.redirect.Load().String(), owner.URL+"/"; got != want {
+		t.Fatalf("Expected to be redirected to %s, got %s", want, got)
+	}
+	if u, _ := c.endpoint("push"); u.String() != owner.URL+"/push" {
+		t.Errorf("Expected pushes to go to %s, got %s", owner.URL, u)
+	}
+	if err := c.doPoll(context.Background(), lb.Client()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPollRedirectLoop(t *testing.T) {
+	// Two replicas, each thinking the other owns the client.
+	var a, b *httptest.Server
+	a = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, b.URL+"/poll", http.StatusTemporaryRedirect)
+	}))
+	defer a.Close()
+	b = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, a.URL+"/poll", http.StatusTemporaryRedirect)
+	}))
+	defer b.Close()
+	c := &Coordinator{logger: promslog.NewNopLogger()}
+	*proxyURL = a.URL + "/"
+
+	if err := c.doPoll(context.Background(), a.Client()); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.doPoll(context.Background(), a.Client()); err == nil {
+		t.Error("Expected being redirected back to be an error, to back off")
+	}
+	if got, want := c.redirect.Load().String(), a.URL+"/"; got != want {
+		t.Errorf("Expected to be redirected to %s, got %s", want, got)
+	}
+}
+
+func TestRedirectToSameProxy(t *testing.T) {
+	c := &Coordinator{logger: promslog.NewNopLogger()}
+	b, _ := url.Parse("http://b.example.com/")
+	// Polls of several workers are redirected at once.
+	for range 2 {
+		if err := c.redirectTo(b); err != nil {
+			t.Fatalf("Expected being redirected to the same proxy not to be an error, got %v", err)
+		}
+	}
+	a, _ := url.Parse("http://a.example.com/")
+	if err := c.redirectTo(a); err == nil {
+		t.Error("Expected being redirected elsewhere to be an error")
+	}
+}
+
+func TestPollReconnect(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(util.ReconnectHeader, "1")
+		http.Error(w, "Proxy is shutting down", http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+	c := &Coordinator{logger: promslog.NewNopLogger()}
+	*proxyURL = "http://proxy.example.com/"
+	// Redirected to the replica which is shutting down.
+	redirect, _ := url.Parse(ts.URL + "/")
+	c.redirect.Store(redirect)
+	if err := c.doPoll(context.Background(), ts.Client()); err != nil {
+		t.Fatalf("Expected reconnect not to be an error, got %v", err)
+	}
+	if c.redirect.Load() != nil {
+		t.Error("Expected redirect to be forgotten")
+	}
+}
+
+func TestReadiness(t *testing.T) {
+	pushed := make(chan struct{}, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/push" {
+			pushed <- struct{}{}
+			return
+		}
+		fmt.Fprintln(w, "GET /index.html HTTP/1.0\n\nOK")
+	}))
+	defer ts.Close()
+	c := &Coordinator{logger: promslog.NewNopLogger()}
+	*proxyURL = ts.URL
+	*readyMaxPollAge = time.Minute
+	h := c.newMetricsHandler()
+	status := func(path string) int {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w.Code
+	}
+
+	if code := status("/-/healthy"); code != http.StatusOK {
+		t.Errorf("Expected healthy, got %d", code)
+	}
+	if code := status("/-/ready"); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected not ready before polling, got %d", code)
+	}
+	if err := c.doPoll(context.Background(), ts.Client()); err != nil {
+		t.Fatal(err)
+	}
+	if code := status("/-/ready"); code != http.StatusOK {
+		t.Errorf("Expected ready after polling, got %d", code)
+	}
+	if v := testutil.ToFloat64(connectedGauge); v != 1 {
+		t.Errorf("Expected to be connected, got %v", v)
+	}
+	// The polled scrape still uses the proxy URL.
+	<-pushed
+
+	*proxyURL = "http://127.0.0.1:0/"
+	if err := c.doPoll(context.Background(), ts.Client()); err == nil {
+		t.Fatal("Expected poll to fail")
+	}
+	if code := status("/-/ready"); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected not ready after failed poll, got %d", code)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	deregistered := make(chan string, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/deregister" {
+			body, _ := io.ReadAll(r.Body)
+			deregistered <- string(body)
+		}
+	}))
+	defer ts.Close()
+	c := &Coordinator{logger: promslog.NewNopLogger()}
+	*proxyURL = ts.URL + "/"
+	*myFqdn = "client.example.com"
+
+	c.scrapes.Add(1)
+	done := make(chan error)
+	go func() {
+		done <- c.shutdown(context.Background(), ts.Client())
+	}()
+	select {
+	case <-deregistered:
+		t.Fatal("Expected to deregister only after in-flight scrapes finished")
+	case <-time.After(50 * time.Millisecond):
+	}
+	c.scrapes.Done()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if fqdn := <-deregistered; fqdn != "client.example.com" {
+		t.Errorf("Expected client.example.com to deregister, got %q", fqdn)
+	}
+
+	// MQTT clients deregister by going offline at the broker.
+	*transportMode = "mqtt"
+	defer func() { *transportMode = "poll" }()
+	if err := c.shutdown(context.Background(), ts.Client()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-deregistered:
+		t.Error("Expected an MQTT client not to deregister at the proxy")
+	default:
+	}
+}
+
+func TestPollWorkers(t *testing.T) {
+	const workers = 3
+	polls := make(chan struct{}, workers)
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		polls <- struct{}{}
+		<-release
+		w.Header().Set(util.ReconnectHeader, "1")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+	c := &Coordinator{logger: promslog.NewNopLogger()}
+	*proxyURL = ts.URL + "/"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		c.run(ctx, workers, ts.Client())
+		close(done)
+	}()
+	for range workers {
+		select {
+		case <-polls:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Expected all workers to poll at once")
+		}
+	}
+	for deadline := time.Now().Add(5 * time.Second); c.conn.pending.Load() != workers; {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d outstanding polls, got %d", workers, c.conn.pending.Load())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	close(release)
+	<-done
 }
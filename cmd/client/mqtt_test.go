@@ -0,0 +1,125 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	mqttserver "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/prometheus/common/promslog"
+
+	"github.com/prometheus-community/pushprox/util"
+)
+
+// startBroker starts an embedded MQTT broker, returning its URL.
+func startBroker(t *testing.T) string {
+	s := mqttserver.New(&mqttserver.Options{Logger: slog.New(slog.DiscardHandler)})
+	if err := s.AddHook(new(auth.AllowHook), nil); err != nil {
+		t.Fatal(err)
+	}
+	tcp := listeners.NewTCP(listeners.Config{ID: "tcp", Address: "127.0.0.1:0"})
+	if err := s.AddListener(tcp); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Serve(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return "tcp://" + tcp.Address()
+}
+
+func TestMQTT(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "up 1\n")
+	}))
+	defer target.Close()
+	u, _ := url.Parse(target.URL)
+	*myFqdn = u.Hostname()
+	*mqttBroker = startBroker(t)
+	*mqttTopicPrefix = "pushprox"
+
+	// The proxy sends a scrape once the client is online.
+	status := make(chan string, 2)
+	pushed := make(chan *http.Response, 1)
+	proxy := mqtt.NewClient(mqtt.NewClientOptions().AddBroker(*mqttBroker).SetClientID("proxy"))
+	if tok := proxy.Connect(); tok.Wait() && tok.Error() != nil {
+		t.Fatal(tok.Error())
+	}
+	defer proxy.Disconnect(0)
+	proxy.Subscribe(util.MQTTTopic("pushprox", *myFqdn, util.MQTTResultTopic), util.MQTTQoS, func(_ mqtt.Client, msg mqtt.Message) {
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(msg.Payload())), nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		pushed <- resp
+	}).Wait()
+	proxy.Subscribe(util.MQTTTopic("pushprox", *myFqdn, util.MQTTStatusTopic), util.MQTTQoS, func(_ mqtt.Client, msg mqtt.Message) {
+		status <- string(msg.Payload())
+	}).Wait()
+
+	c := &Coordinator{logger: promslog.NewNopLogger()}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- c.doMQTT(ctx, target.Client())
+	}()
+	select {
+	case s := <-status:
+		if s != util.MQTTOnline {
+			t.Fatalf("Expected the client to come online, got %q", s)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the client to come online")
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, target.URL+"/metrics", nil)
+	req.Header.Set("Id", "a")
+	req.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", "10")
+	buf := &bytes.Buffer{}
+	req.WriteProxy(buf)
+	proxy.Publish(util.MQTTTopic("pushprox", *myFqdn, util.MQTTRequestTopic), util.MQTTQoS, false, buf.Bytes()).Wait()
+	select {
+	case resp := <-pushed:
+		body, _ := io.ReadAll(resp.Body)
+		if resp.Header.Get("Id") != "a" || string(body) != "up 1\n" {
+			t.Errorf("Unexpected result %v: %q", resp.Header, body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the result to be published")
+	}
+	c.scrapes.Wait()
+
+	cancel()
+	<-done
+	select {
+	case s := <-status:
+		if s != util.MQTTOffline {
+			t.Errorf("Expected the client to go offline, got %q", s)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the client to go offline")
+	}
+}
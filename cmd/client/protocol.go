@@ -0,0 +1,205 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+
+	"github.com/prometheus-community/pushprox/util"
+)
+
+var maxBatchSize = kingpin.Flag("proxy.max-batch-size", "Maximum number of scrapes to accept in a single poll, and of results to push at once, if the proxy supports it. 1 disables batching.").Default("10").Int()
+
+// negotiatedKey marks scrape requests with the protocol negotiated on the
+// poll they were received with.
+type negotiatedKey struct{}
+
+type negotiated struct {
+	version      int
+	capabilities util.Capabilities
+	// Stream to send results on, if the scrape came from one.
+	stream resultWriter
+}
+
+// resultWriter sends scrape results to the proxy on a stream.
+type resultWriter interface {
+	WriteResult(resp *http.Response) error
+}
+
+// frameWriter sends frames to the proxy, e.g. on a stream or WebSocket.
+type frameWriter interface {
+	WriteFrame(typ byte, payload []byte) error
+}
+
+// frameResults sends results as frames in HTTP wire format.
+type frameResults struct {
+	frameWriter
+}
+
+func (f frameResults) WriteResult(resp *http.Response) error {
+	buf := &bytes.Buffer{}
+	if err := resp.Write(buf); err != nil {
+		return err
+	}
+	return f.WriteFrame(util.FrameScrapeResponse, buf.Bytes())
+}
+
+// frameReader receives frames from the proxy.
+type frameReader interface {
+	ReadFrame() (byte, []byte, error)
+}
+
+// negotiatedFor returns the protocol to push the result of a scrape with.
+func negotiatedFor(r *http.Request) negotiated {
+	if n, ok := r.Context().Value(negotiatedKey{}).(negotiated); ok {
+		return n
+	}
+	return negotiated{version: util.ProtocolVersion1}
+}
+
+// newPoll returns the poll offering the capabilities of this client.
+func (c *Coordinator) newPoll() util.Poll {
+	caps := util.Capabilities{}
+	if *maxBatchSize > 1 {
+		caps[util.CapabilityBatch] = *maxBatchSize
+	}
+	if util.IsSupportedEncoding(*pushCompression) {
+		caps[*pushCompression] = 0
+	}
+	if n := c.limiter.capacity(); *advertiseLimit && n > 0 {
+		caps[util.CapabilityScrapeLimit] = n
+	}
+	return util.Poll{FQDN: *myFqdn, Version: util.ProtocolVersion, Capabilities: caps}
+}
+
+// readPollResponse returns the scrape requests of a poll response.
+func readPollResponse(resp *http.Response) ([]*http.Request, error) {
+	pr, err := util.ReadPollResponse(resp)
+	if err != nil {
+		return nil, err
+	}
+	n := negotiated{version: pr.Version, capabilities: pr.Capabilities}
+	for i, request := range pr.Requests {
+		pr.Requests[i] = request.WithContext(context.WithValue(request.Context(), negotiatedKey{}, n))
+	}
+	return pr.Requests, nil
+}
+
+// pushBatcher collects results finishing while a push is in flight, to send
+// them together in the next push. A result finishing while no push is in
+// flight is pushed right away.
+type pushBatcher struct {
+	mu      sync.Mutex
+	pending []*batchedPush
+	sending bool
+}
+
+type batchedPush struct {
+	version int
+	// Largest batch this result may be pushed in.
+	size int
+	// Deadline of the scrape, zero for none.
+	deadline time.Time
+	msg      []byte
+	done     chan error
+}
+
+// pushBatched pushes a serialized scrape response with the next batch, and
+// waits for the batch to be pushed.
+func (c *Coordinator) pushBatched(client *http.Client, n negotiated, deadline time.Time, msg []byte) error {
+	b := &c.batcher
+	size := max(*maxBatchSize, 1)
+	if accepted := n.capabilities[util.CapabilityBatch]; accepted > 0 {
+		size = min(size, accepted)
+	}
+	p := &batchedPush{version: n.version, size: size, deadline: deadline, msg: msg, done: make(chan error, 1)}
+	b.mu.Lock()
+	b.pending = append(b.pending, p)
+	if !b.sending {
+		b.sending = true
+		go c.sendBatches(client)
+	}
+	b.mu.Unlock()
+	return <-p.done
+}
+
+// sendBatches pushes pending results, as many at once as the first of them
+// allows, until there are none.
+func (c *Coordinator) sendBatches(client *http.Client) {
+	b := &c.batcher
+	for {
+		b.mu.Lock()
+		n := len(b.pending)
+		if n > 0 {
+			n = min(n, b.pending[0].size)
+		}
+		if n == 0 {
+			b.sending = false
+			b.mu.Unlock()
+			return
+		}
+		batch := b.pending[:n:n]
+		b.pending = b.pending[n:]
+		b.mu.Unlock()
+
+		err := c.sendBatch(client, batch)
+		for _, p := range batch {
+			p.done <- err
+		}
+	}
+}
+
+func (c *Coordinator) sendBatch(client *http.Client, batch []*batchedPush) error {
+	u, err := c.endpoint("push")
+	if err != nil {
+		return err
+	}
+	// Pushing after the first scrape of the batch timed out is pointless.
+	ctx := context.Background()
+	var deadline time.Time
+	msgs := make([][]byte, len(batch))
+	for i, p := range batch {
+		msgs[i] = p.msg
+		if !p.deadline.IsZero() && (deadline.IsZero() || p.deadline.Before(deadline)) {
+			deadline = p.deadline
+		}
+	}
+	if !deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+	request, err := util.NewPushRequest(ctx, u.String(), batch[0].version, msgs...)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("pushing batch of %d: unexpected status %s: %s", len(batch), resp.Status, bytes.TrimSpace(body))
+	}
+	c.logger.Debug("Pushed batch", "size", len(batch))
+	return nil
+}
@@ -0,0 +1,247 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/promslog"
+
+	"github.com/prometheus-community/pushprox/util"
+)
+
+func TestBatchedPoll(t *testing.T) {
+	pushed := make(chan string, 10)
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/poll":
+			poll, err := util.DecodePoll(r)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if got := poll.Capabilities[util.CapabilityBatch]; got != 10 {
+				t.Errorf("Expected poll to accept batches of 10, got %d", got)
+			}
+			version, caps := util.Negotiate(poll, util.Capabilities{util.CapabilityBatch: 100})
+			resp := util.PollResponse{Version: version, Capabilities: caps}
+			for _, id := range []string{"a", "b"} {
+				req, _ := http.NewRequest(http.MethodGet, ts.URL+"/metrics", nil)
+				req.Header.Set("Id", id)
+				req.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", "10")
+				resp.Requests = append(resp.Requests, req)
+			}
+			if err := util.WritePollResponse(w, resp); err != nil {
+				t.Error(err)
+			}
+		case "/metrics":
+			io.WriteString(w, "up 1\n")
+		case "/push":
+			if v := r.Header.Get(util.ProtocolVersionHeader); v != "2" {
+				t.Errorf("Expected push with protocol version 2, got %q", v)
+			}
+			resps, err := util.ReadPush(r)
+			if err != nil {
+				t.Error(err)
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			for _, resp := range resps {
+				pushed <- resp.Header.Get("Id")
+			}
+		}
+	}))
+	defer ts.Close()
+	u, _ := url.Parse(ts.URL)
+	*proxyURL = ts.URL + "/"
+	*myFqdn = u.Hostname()
+	*maxBatchSize = 10
+	defer func() { *maxBatchSize = 0 }()
+	c := &Coordinator{logger: promslog.NewNopLogger()}
+
+	if err := c.doPoll(context.Background(), ts.Client()); err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]bool{}
+	for range 2 {
+		select {
+		case id := <-pushed:
+			got[id] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected results of both scrapes to be pushed, got %v", got)
+		}
+	}
+	if !got["a"] || !got["b"] {
+		t.Errorf("Expected results of scrapes a and b, got %v", got)
+	}
+	c.scrapes.Wait()
+}
+
+func TestStreamedPush(t *testing.T) {
+	large := strings.Repeat("a 1\n", maxBatchedResultSize)
+	pushed := make(chan int, 1)
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/poll":
+			poll, _ := util.DecodePoll(r)
+			version, caps := util.Negotiate(poll, util.Capabilities{util.CapabilityBatch: 100})
+			req, _ := http.NewRequest(http.MethodGet, ts.URL+"/metrics", nil)
+			req.Header.Set("Id", "a")
+			req.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", "10")
+			util.WritePollResponse(w, util.PollResponse{Version: version, Capabilities: caps, Requests: []*http.Request{req}})
+		case "/metrics":
+			io.WriteString(w, large)
+		case "/push":
+			if !util.IsStreamedPush(r) {
+				t.Error("Expected a large result to be pushed on its own")
+			}
+			resps, err := util.ReadPush(r)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			body, _ := io.ReadAll(resps[0].Body)
+			pushed <- len(body)
+		}
+	}))
+	defer ts.Close()
+	u, _ := url.Parse(ts.URL)
+	*proxyURL = ts.URL + "/"
+	*myFqdn = u.Hostname()
+	*maxBatchSize = 10
+	defer func() { *maxBatchSize = 0 }()
+	c := &Coordinator{logger: promslog.NewNopLogger()}
+
+	if err := c.doPoll(context.Background(), ts.Client()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case n := <-pushed:
+		if n != len(large) {
+			t.Errorf("Expected %d bytes pushed, got %d", len(large), n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the result to be pushed")
+	}
+	c.scrapes.Wait()
+}
+
+func TestStreamedPushRejected(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Like the proxy once Prometheus went away.
+		io.ReadFull(r.Body, make([]byte, 10))
+		w.Header().Set("Connection", "close")
+		http.Error(w, "scrape result abandoned", http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+	*proxyURL = ts.URL + "/"
+	c := &Coordinator{logger: promslog.NewNopLogger()}
+
+	// A target sending its result slowly.
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	go io.WriteString(pw, "up 1\n")
+	resp := &http.Response{StatusCode: http.StatusOK, ProtoMajor: 1, ProtoMinor: 1, Header: http.Header{}, Body: pr, ContentLength: -1}
+	request, _ := http.NewRequest(http.MethodGet, "http://example.com/metrics", nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := c.doPush(resp, request.WithContext(ctx), ts.Client()); err == nil {
+		t.Fatal("Expected the push to fail")
+	}
+	if ctx.Err() != nil {
+		t.Fatal("Expected the push to fail once the proxy answered")
+	}
+}
+
+func TestPushBatchedSize(t *testing.T) {
+	sizes := make(chan int, 10)
+	first, hold := make(chan struct{}), make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resps, err := util.ReadPush(r)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		switch resps[0].Header.Get("Id") {
+		case "first":
+			// Further results pile up meanwhile.
+			close(first)
+			<-hold
+		case "hang":
+			<-r.Context().Done()
+			return
+		}
+		sizes <- len(resps)
+	}))
+	defer ts.Close()
+	*proxyURL = ts.URL + "/"
+	*maxBatchSize = 10
+	defer func() { *maxBatchSize = 0 }()
+	c := &Coordinator{logger: promslog.NewNopLogger()}
+	msg := func(id string) []byte {
+		return []byte("HTTP/1.1 200 OK\r\nId: " + id + "\r\nContent-Length: 0\r\n\r\n")
+	}
+	// The proxy accepts smaller batches than the client.
+	n := negotiated{version: util.ProtocolVersion, capabilities: util.Capabilities{util.CapabilityBatch: 2}}
+
+	errs := make(chan error, 4)
+	go func() { errs <- c.pushBatched(ts.Client(), n, time.Time{}, msg("first")) }()
+	<-first
+	for _, id := range []string{"a", "b", "c"} {
+		go func() { errs <- c.pushBatched(ts.Client(), n, time.Time{}, msg(id)) }()
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		c.batcher.mu.Lock()
+		pending := len(c.batcher.pending)
+		c.batcher.mu.Unlock()
+		if pending == 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected 3 results to be pending, got %d", pending)
+		}
+	}
+	close(hold)
+	for range 4 {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, want := range []int{1, 2, 1} {
+		select {
+		case got := <-sizes:
+			if got != want {
+				t.Errorf("Expected a batch of %d, got %d", want, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected a batch of %d", want)
+		}
+	}
+
+	// A push is given up once the first scrape of its batch timed out.
+	err := c.pushBatched(ts.Client(), n, time.Now().Add(100*time.Millisecond), msg("hang"))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the push to time out, got %v", err)
+	}
+}
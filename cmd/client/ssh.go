@@ -0,0 +1,161 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"github.com/prometheus-community/pushprox/util"
+)
+
+var (
+	sshProxyAddress      = kingpin.Flag("ssh.proxy-address", "Address (host:port) of the SSH server of the proxy to connect to with --transport=ssh.").String()
+	sshKey               = kingpin.Flag("ssh.key", "Private key to authenticate to the proxy with via SSH.").String()
+	sshKnownHosts        = kingpin.Flag("ssh.known-hosts", "known_hosts file with the host key of the proxy.").String()
+	sshKeepaliveInterval = kingpin.Flag("ssh.keepalive-interval", "How often to check that the SSH connection to the proxy is alive.").Default("30s").Duration()
+)
+
+// newSSHConfigFromFlags returns the configuration to connect to the proxy
+// via SSH with.
+func newSSHConfigFromFlags() (*ssh.ClientConfig, error) {
+	b, err := os.ReadFile(*sshKey)
+	if err != nil {
+		return nil, err
+	}
+	key, err := ssh.ParsePrivateKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", *sshKey, err)
+	}
+	hostKeys, err := knownhosts.New(*sshKnownHosts)
+	if err != nil {
+		return nil, err
+	}
+	return &ssh.ClientConfig{
+		User:            *myFqdn,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(key)},
+		HostKeyCallback: hostKeys,
+		Timeout:         30 * time.Second,
+	}, nil
+}
+
+// doSSH connects to the SSH server of the proxy and runs the scrapes it sends
+// on channels of their own, answering on the same channel, until the
+// connection is closed.
+func (c *Coordinator) doSSH(ctx context.Context, client *http.Client) (err error) {
+	dialer := net.Dialer{Timeout: c.sshConfig.Timeout}
+	nc, err := dialer.DialContext(ctx, "tcp", *sshProxyAddress)
+	var conn ssh.Conn
+	var chans <-chan ssh.NewChannel
+	var reqs <-chan *ssh.Request
+	if err == nil {
+		conn, chans, reqs, err = ssh.NewClientConn(nc, *sshProxyAddress, c.sshConfig)
+		if err != nil {
+			nc.Close()
+		}
+	}
+	if err != nil && ctx.Err() != nil {
+		// Shutting down.
+		return err
+	}
+	if err != nil {
+		c.logger.Error("Error connecting via SSH:", "err", err)
+		c.conn.pollDone(false, err)
+		return fmt.Errorf("error connecting via SSH: %w", err)
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	// Whether the proxy asked us to reconnect, known once requests are done.
+	var reconnect atomic.Bool
+	requestsDone := make(chan struct{})
+	go func() {
+		defer close(requestsDone)
+		for req := range reqs {
+			if req.Type == util.SSHReconnectRequest {
+				reconnect.Store(true)
+			}
+			if req.WantReply {
+				req.Reply(false, nil) //nolint:errcheck
+			}
+		}
+	}()
+	go util.SSHKeepalive(conn, *sshKeepaliveInterval)
+	c.conn.pollSent()
+	defer func() {
+		c.conn.pollDone(true, err)
+	}()
+	c.logger.Info("Connected via SSH")
+
+	for newCh := range chans {
+		if newCh.ChannelType() != util.SSHScrapeChannel {
+			newCh.Reject(ssh.UnknownChannelType, "unknown channel type") //nolint:errcheck
+			continue
+		}
+		ch, chReqs, err := newCh.Accept()
+		if err != nil {
+			continue
+		}
+		go ssh.DiscardRequests(chReqs)
+		go func() {
+			request, err := http.ReadRequest(bufio.NewReader(ch))
+			if err != nil {
+				c.logger.Error("Error reading request:", "err", err)
+				ch.Close()
+				return
+			}
+			n := negotiated{version: util.ProtocolVersion, stream: sshResult{ch}}
+			c.startScrape(request.WithContext(context.WithValue(request.Context(), negotiatedKey{}, n)), client)
+		}()
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	<-requestsDone
+	if reconnect.Load() {
+		// The proxy is going away, connect again right away.
+		c.logger.Info("Proxy asked to reconnect")
+		return nil
+	}
+	if err := conn.Wait(); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("SSH connection closed: %w", err)
+	}
+	// Back off, rather than connect again and again to a proxy turning us
+	// away.
+	return errors.New("SSH connection closed by proxy")
+}
+
+// sshResult answers a scrape on its channel.
+type sshResult struct {
+	ch ssh.Channel
+}
+
+func (s sshResult) WriteResult(resp *http.Response) error {
+	defer s.ch.Close()
+	if err := resp.Write(s.ch); err != nil {
+		return err
+	}
+	return s.ch.CloseWrite()
+}
@@ -0,0 +1,161 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/promslog"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/prometheus-community/pushprox/util"
+)
+
+func newSSHSigner(t *testing.T) ssh.Signer {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// startSSHProxy sends a single scrape to the first client connecting and
+// returns its response. It then closes the connection, asking the client to
+// reconnect if told to.
+func startSSHProxy(t *testing.T, target string, clientKey ssh.PublicKey, reconnect bool) (ssh.PublicKey, <-chan sshResponse) {
+	hostKey := newSSHSigner(t)
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if ssh.FingerprintSHA256(key) != ssh.FingerprintSHA256(clientKey) {
+				return nil, io.ErrUnexpectedEOF
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostKey)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	*sshProxyAddress = l.Addr().String()
+
+	responses := make(chan sshResponse, 1)
+	go func() {
+		nc, err := l.Accept()
+		if err != nil {
+			return
+		}
+		conn, chans, reqs, err := ssh.NewServerConn(nc, config)
+		if err != nil {
+			t.Error(err)
+			nc.Close()
+			return
+		}
+		defer conn.Close()
+		go ssh.DiscardRequests(reqs)
+		go func() {
+			for newCh := range chans {
+				newCh.Reject(ssh.Prohibited, "")
+			}
+		}()
+
+		ch, chReqs, err := conn.OpenChannel(util.SSHScrapeChannel, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		go ssh.DiscardRequests(chReqs)
+		request, _ := http.NewRequest(http.MethodGet, target+"/metrics", nil)
+		request.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", "10")
+		if err := request.WriteProxy(ch); err != nil {
+			t.Error(err)
+			return
+		}
+		ch.CloseWrite()
+		resp, err := http.ReadResponse(bufio.NewReader(ch), request)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		body, _ := io.ReadAll(resp.Body)
+		responses <- sshResponse{resp.StatusCode, string(body)}
+		if reconnect {
+			conn.SendRequest(util.SSHReconnectRequest, false, nil)
+		}
+	}()
+	return hostKey.PublicKey(), responses
+}
+
+type sshResponse struct {
+	status int
+	body   string
+}
+
+func TestSSH(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "up 1\n")
+	}))
+	defer target.Close()
+	u, _ := url.Parse(target.URL)
+	*myFqdn = u.Hostname()
+
+	*sshKeepaliveInterval = time.Minute
+	clientKey := newSSHSigner(t)
+	hostKey, responses := startSSHProxy(t, target.URL, clientKey.PublicKey(), true)
+
+	c := &Coordinator{
+		logger: promslog.NewNopLogger(),
+		sshConfig: &ssh.ClientConfig{
+			User:            *myFqdn,
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(clientKey)},
+			HostKeyCallback: ssh.FixedHostKey(hostKey),
+		},
+	}
+	// The fake proxy asks to reconnect after the scrape.
+	if err := c.doSSH(context.Background(), target.Client()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case resp := <-responses:
+		if resp.status != http.StatusOK || resp.body != "up 1\n" {
+			t.Errorf("Unexpected response %d %q", resp.status, resp.body)
+		}
+	default:
+		t.Fatal("Expected the result on the scrape channel")
+	}
+	c.scrapes.Wait()
+
+	// A connection closed without asking to reconnect is backed off from.
+	hostKey, responses = startSSHProxy(t, target.URL, clientKey.PublicKey(), false)
+	c.sshConfig.HostKeyCallback = ssh.FixedHostKey(hostKey)
+	if err := c.doSSH(context.Background(), target.Client()); err == nil {
+		t.Error("Expected an error for a connection closed by the proxy")
+	}
+	<-responses
+	c.scrapes.Wait()
+}
@@ -0,0 +1,120 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/prometheus-community/pushprox/util"
+)
+
+// doStream opens a stream to the proxy and runs the scrapes received on it,
+// sending their results back on the same stream, until the stream ends.
+func (c *Coordinator) doStream(ctx context.Context, client *http.Client) (err error) {
+	if c.noStreams.Load() {
+		return c.doPoll(ctx, client)
+	}
+	streamURL, err := c.endpoint("stream")
+	if err != nil {
+		return fmt.Errorf("error parsing url: %w", err)
+	}
+	streamClient := *client
+	if c.streamClient != nil {
+		streamClient = *c.streamClient
+	}
+	// Redirects are followed by hand, as for polls.
+	streamClient.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	pr, pw := io.Pipe()
+	request, err := util.NewStreamRequest(ctx, streamURL.String(), c.newPoll(), pr)
+	if err != nil {
+		return err
+	}
+	resp, err := streamClient.Do(request)
+	if err != nil && ctx.Err() != nil {
+		// Shutting down.
+		pw.Close()
+		return err
+	}
+	if err != nil {
+		pw.Close()
+		c.logger.Error("Error opening stream:", "err", err)
+		c.redirect.Store(nil)
+		c.conn.pollDone(false, err)
+		return fmt.Errorf("error opening stream: %w", err)
+	}
+	defer func() {
+		// Ends our side of the stream, failing pushes of scrapes still
+		// running. This has to come first, as closing the body waits for
+		// the request to be written.
+		pw.Close()
+		resp.Body.Close()
+	}()
+
+	if handled, err := c.followProxy(resp); handled {
+		return err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		c.logger.Warn("Proxy does not support streams, falling back to polling")
+		c.noStreams.Store(true)
+		return nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("error opening stream: unexpected status %s", resp.Status)
+		c.conn.pollDone(false, err)
+		return err
+	}
+	c.conn.pollSent()
+	defer func() {
+		c.conn.pollDone(true, err)
+	}()
+	c.logger.Info("Opened stream")
+
+	version, caps := util.ReadStreamHeader(resp)
+	n := negotiated{version: version, capabilities: caps, stream: frameResults{util.NewFrameWriter(pw, nil)}}
+	return c.readFrames(ctx, util.NewFrameReader(resp.Body), n, client)
+}
+
+// readFrames runs the scrapes read from r, pushing their results as
+// negotiated in n, until the proxy closes its side.
+func (c *Coordinator) readFrames(ctx context.Context, r frameReader, n negotiated, client *http.Client) error {
+	for {
+		typ, payload, err := r.ReadFrame()
+		if errors.Is(err, io.EOF) {
+			c.logger.Info("Stream closed by proxy")
+			return nil
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			return fmt.Errorf("error reading stream: %w", err)
+		}
+		if typ != util.FrameScrapeRequest {
+			c.logger.Warn("Ignoring unexpected frame on stream", "type", typ)
+			continue
+		}
+		request, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(payload)))
+		if err != nil {
+			return fmt.Errorf("error reading request: %w", err)
+		}
+		c.startScrape(request.WithContext(context.WithValue(request.Context(), negotiatedKey{}, n)), client)
+	}
+}
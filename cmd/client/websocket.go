@@ -0,0 +1,90 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/gorilla/websocket"
+
+	"github.com/prometheus-community/pushprox/util"
+)
+
+var websocketPingInterval = kingpin.Flag("websocket.ping-interval", "How often to ping the proxy when connected via WebSocket. The connection is reopened if the proxy does not answer within twice this.").Default("30s").Duration()
+
+// doWebSocket opens a WebSocket to the proxy and runs the scrapes received on
+// it, sending their results back on the same WebSocket, until it is closed.
+func (c *Coordinator) doWebSocket(ctx context.Context, client *http.Client) (err error) {
+	if c.noStreams.Load() {
+		return c.doPoll(ctx, client)
+	}
+	wsURL, err := c.endpoint("websocket")
+	if err != nil {
+		return fmt.Errorf("error parsing url: %w", err)
+	}
+	switch wsURL.Scheme {
+	case "https":
+		wsURL.Scheme = "wss"
+	default:
+		wsURL.Scheme = "ws"
+	}
+	dialer := c.dialer
+	if dialer == nil {
+		dialer = websocket.DefaultDialer
+	}
+	ws, resp, err := dialer.DialContext(ctx, wsURL.String(), util.StreamHeader(c.newPoll()))
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if errors.Is(err, websocket.ErrBadHandshake) {
+		if handled, err := c.followProxy(resp); handled {
+			return err
+		}
+		if resp.StatusCode == http.StatusNotFound {
+			c.logger.Warn("Proxy does not support WebSockets, falling back to polling")
+			c.noStreams.Store(true)
+			return nil
+		}
+		err = fmt.Errorf("error opening WebSocket: unexpected status %s", resp.Status)
+		c.conn.pollDone(false, err)
+		return err
+	}
+	if err != nil && ctx.Err() != nil {
+		// Shutting down.
+		return err
+	}
+	if err != nil {
+		c.logger.Error("Error opening WebSocket:", "err", err)
+		c.redirect.Store(nil)
+		c.conn.pollDone(false, err)
+		return fmt.Errorf("error opening WebSocket: %w", err)
+	}
+	c.conn.pollSent()
+	defer func() {
+		c.conn.pollDone(true, err)
+	}()
+	c.logger.Info("Opened WebSocket")
+
+	conn := util.NewWebSocketConn(ws, *websocketPingInterval, util.DefaultFrameReadLimit)
+	// Closing fails pushes of scrapes still running.
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	version, caps := util.ReadStreamHeader(resp)
+	n := negotiated{version: version, capabilities: caps, stream: frameResults{conn}}
+	return c.readFrames(ctx, conn, n, client)
+}
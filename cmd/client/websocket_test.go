@@ -0,0 +1,117 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/common/promslog"
+
+	"github.com/prometheus-community/pushprox/util"
+)
+
+func TestWebSocket(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "up 1\n")
+	}))
+	defer target.Close()
+	u, _ := url.Parse(target.URL)
+	*myFqdn = u.Hostname()
+	*websocketPingInterval = time.Minute
+
+	pushed := make(chan *http.Response, 1)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/websocket" || r.Header.Get(util.FQDNHeader) != *myFqdn {
+			http.NotFound(w, r)
+			return
+		}
+		ws, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conn := util.NewWebSocketConn(ws, time.Minute, util.DefaultFrameReadLimit)
+		defer conn.Close()
+		req, _ := http.NewRequest(http.MethodGet, target.URL+"/metrics", nil)
+		req.Header.Set("Id", "a")
+		req.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", "10")
+		buf := &bytes.Buffer{}
+		req.WriteProxy(buf)
+		if err := conn.WriteFrame(util.FrameScrapeRequest, buf.Bytes()); err != nil {
+			t.Error(err)
+			return
+		}
+		typ, payload, err := conn.ReadFrame()
+		if err != nil || typ != util.FrameScrapeResponse {
+			t.Errorf("Expected a scrape response, got frame type %d: %v", typ, err)
+			return
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(payload)), nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		pushed <- resp
+	}))
+	defer proxy.Close()
+	*proxyURL = proxy.URL + "/"
+
+	c := &Coordinator{logger: promslog.NewNopLogger()}
+	if err := c.doWebSocket(context.Background(), target.Client()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case resp := <-pushed:
+		body, _ := io.ReadAll(resp.Body)
+		if resp.Header.Get("Id") != "a" || string(body) != "up 1\n" {
+			t.Errorf("Unexpected result %v: %q", resp.Header, body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the result on the WebSocket")
+	}
+	c.scrapes.Wait()
+}
+
+func TestWebSocketFallback(t *testing.T) {
+	old := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/poll":
+			w.Header().Set(util.ReconnectHeader, "1")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer old.Close()
+	*proxyURL = old.URL + "/"
+	c := &Coordinator{logger: promslog.NewNopLogger()}
+
+	if err := c.doWebSocket(context.Background(), old.Client()); err != nil {
+		t.Fatal(err)
+	}
+	if !c.noStreams.Load() {
+		t.Fatal("Expected to fall back to polling")
+	}
+	if err := c.doWebSocket(context.Background(), old.Client()); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/base64"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/prometheus-community/pushprox/util"
+)
+
+var (
+	auditFile           = kingpin.Flag("audit.file", "File to write the JSON lines audit log to. Disabled if empty.").String()
+	auditMaxSize        = kingpin.Flag("audit.max-size", "Size after which the audit log is rotated.").Default("100MB").Bytes()
+	auditMaxBackups     = kingpin.Flag("audit.max-backups", "Number of rotated audit logs to keep.").Default("5").Int()
+	auditIdentityHeader = kingpin.Flag("audit.identity-header", "Request header carrying the identity authenticated by a reverse proxy in front of the proxy.").String()
+)
+
+var (
+	auditDropped = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "audit_entries_dropped_total",
+			Help:      "Number of audit log entries which could not be written.",
+		},
+	)
+)
+
+// Audit event types.
+const (
+	auditScrape     = "scrape"
+	auditRegister   = "register"
+	auditExpire     = "expire"
+	auditForget     = "forget"
+	auditDeregister = "deregister"
+)
+
+// auditEntry is a single line of the audit log.
+type auditEntry struct {
+	Timestamp time.Time `json:"timestamp"`
+	Event     string    `json:"event"`
+	Source    string    `json:"source,omitempty"`
+	Identity  string    `json:"identity,omitempty"`        // Verified by TLS or a reverse proxy.
+	User      string    `json:"unverified_user,omitempty"` // Claimed by credentials, not verified.
+	FQDN      string    `json:"fqdn"`
+	ScrapeID  string    `json:"scrape_id,omitempty"`
+	URL       string    `json:"url,omitempty"`
+	Status    int       `json:"status,omitempty"`
+	Bytes     int64     `json:"bytes,omitempty"`
+	Duration  float64   `json:"duration_seconds,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// newAuditLogFromFlags returns the configured audit log, or nil if disabled.
+func newAuditLogFromFlags(logger *slog.Logger) (*util.AuditLog, error) {
+	if *auditFile == "" {
+		return nil, nil
+	}
+	f, err := util.NewRotatingFile(*auditFile, int64(*auditMaxSize), *auditMaxBackups)
+	if err != nil {
+		return nil, err
+	}
+	return util.NewAuditLog(f, auditDropped, logger), nil
+}
+
+// requestIdentity returns who made a request, as verified by TLS or by the
+// reverse proxy in front of the proxy. It is empty if neither did.
+func requestIdentity(r *http.Request) string {
+	if *auditIdentityHeader != "" {
+		if id := r.Header.Get(*auditIdentityHeader); id != "" {
+			return id
+		}
+	}
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		return r.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	return ""
+}
+
+// claimedUser returns the user a request claims to be made by in its
+// credentials, which the proxy does not check.
+func claimedUser(r *http.Request) string {
+	// Prometheus sends the credentials of a proxy_url as Proxy-Authorization.
+	if user, ok := basicAuthUser(r.Header.Get("Proxy-Authorization")); ok {
+		return user
+	}
+	if user, _, ok := r.BasicAuth(); ok {
+		return user
+	}
+	return ""
+}
+
+func basicAuthUser(auth string) (string, bool) {
+	const prefix = "Basic "
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return "", false
+	}
+	c, err := base64.StdEncoding.DecodeString(auth[len(prefix):])
+	if err != nil {
+		return "", false
+	}
+	user, _, ok := strings.Cut(string(c), ":")
+	return user, ok
+}
@@ -0,0 +1,46 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequestIdentity(t *testing.T) {
+	// Credentials are only claimed.
+	r := httptest.NewRequest(http.MethodGet, "http://client.example.com/metrics", nil)
+	r.SetBasicAuth("alice", "secret")
+	if id := requestIdentity(r); id != "" {
+		t.Errorf("Expected no verified identity, got %q", id)
+	}
+	if user := claimedUser(r); user != "alice" {
+		t.Errorf("Expected alice as claimed user, got %q", user)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "http://client.example.com/metrics", nil)
+	r.Header.Set("Proxy-Authorization", "Basic Ym9iOnNlY3JldA==") // bob:secret
+	if user := claimedUser(r); user != "bob" {
+		t.Errorf("Expected bob as claimed user, got %q", user)
+	}
+
+	r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: "prometheus"}}}}
+	if id := requestIdentity(r); id != "prometheus" {
+		t.Errorf("Expected the CN of the certificate, got %q", id)
+	}
+}
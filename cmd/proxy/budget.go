@@ -0,0 +1,244 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	maxPushSize          = kingpin.Flag("push.max-size", "Maximum size of a push from a client, or of a result sent over a connection, 0 for no limit. Larger ones are rejected, failing their scrapes.").Default("0").Bytes()
+	maxInflightPushBytes = kingpin.Flag("push.max-inflight-bytes", "Maximum bytes of pushes and results being received from all clients at once, 0 for no limit. Those beyond are rejected, failing their scrapes.").Default("0").Bytes()
+)
+
+var (
+	pushesRejected = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "pushes_rejected_total",
+			Help:      "Number of pushes rejected for exceeding --push.max-size or --push.max-inflight-bytes.",
+		}, []string{"reason"},
+	)
+	inflightPushBytes = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "inflight_push_bytes",
+			Help:      "Bytes of pushes being received from clients, counting pushes of known size in full.",
+		},
+	)
+)
+
+func init() {
+	pushesRejected.WithLabelValues("too_large")
+	pushesRejected.WithLabelValues("over_budget")
+}
+
+// Errors failing the scrapes of rejected pushes.
+var (
+	errPushTooLarge = errors.New("scrape result is larger than the proxy accepts (--push.max-size)")
+	errOverBudget   = errors.New("proxy is receiving too many scrape results at once (--push.max-inflight-bytes)")
+)
+
+// pushStatus returns the status of a push rejected with err.
+func pushStatus(err error) int {
+	switch {
+	case errors.Is(err, errPushTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, errOverBudget):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// byteBudget bounds the bytes of pushes being received at once.
+type byteBudget struct {
+	mu   sync.Mutex
+	max  int64 // 0 for no limit.
+	used int64
+}
+
+func newByteBudget(max int64) *byteBudget {
+	return &byteBudget{max: max}
+}
+
+// acquire reserves n bytes. It returns false if that exceeds the budget.
+func (b *byteBudget) acquire(n int64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.max > 0 && b.used+n > b.max {
+		return false
+	}
+	b.used += n
+	inflightPushBytes.Set(float64(b.used))
+	return true
+}
+
+func (b *byteBudget) release(n int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.used -= n
+	inflightPushBytes.Set(float64(b.used))
+}
+
+// headerAllowance is how much of a rejected push is still read, to learn
+// which scrapes to fail.
+const headerAllowance = 64 << 10
+
+// pushBody enforces the size limit and the budget on the body of a push. The
+// bytes of pushes of known size are reserved up front, others as they are
+// read.
+type pushBody struct {
+	io.ReadCloser
+	budget *byteBudget
+	max    int64
+
+	// Only used by Read, which is not called concurrently.
+	read       int64
+	headerDone bool
+
+	mu       sync.Mutex
+	reserved int64
+	// Why the push was rejected, if it was.
+	err error
+}
+
+// newPushBody limits body, which is size bytes long, or -1 if unknown.
+func newPushBody(body io.ReadCloser, size int64, budget *byteBudget, max int64) *pushBody {
+	b := &pushBody{ReadCloser: body, budget: budget, max: max}
+	switch {
+	case max > 0 && size > max:
+		b.reject(errPushTooLarge)
+	case size > 0:
+		if budget.acquire(size) {
+			b.reserved = size
+		} else {
+			b.reject(errOverBudget)
+		}
+	}
+	return b
+}
+
+func (b *pushBody) reject(err error) {
+	b.err = err
+	if errors.Is(err, errPushTooLarge) {
+		pushesRejected.WithLabelValues("too_large").Inc()
+	} else {
+		pushesRejected.WithLabelValues("over_budget").Inc()
+	}
+}
+
+// Read fails once the push is rejected, except while the headers of its
+// results are read, up to headerAllowance.
+func (b *pushBody) Read(p []byte) (int, error) {
+	if err := b.rejected(); err != nil && (b.headerDone || b.read >= headerAllowance) {
+		return 0, err
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch extra := b.read - b.reserved; {
+	case b.err != nil:
+	case b.max > 0 && b.read > b.max:
+		b.reject(errPushTooLarge)
+	case extra > 0 && !b.budget.acquire(extra):
+		b.reject(errOverBudget)
+	case extra > 0:
+		b.reserved += extra
+	}
+	if b.err != nil && b.headerDone {
+		return 0, b.err
+	}
+	return n, err
+}
+
+// startResults marks the headers of the results as read.
+func (b *pushBody) startResults() {
+	b.headerDone = true
+}
+
+// rejected returns why the push was rejected, if it was.
+func (b *pushBody) rejected() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.err
+}
+
+// release returns the bytes reserved to the budget.
+func (b *pushBody) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.budget.release(b.reserved)
+	b.reserved = 0
+}
+
+// pushesLimited returns whether --push.max-size or --push.max-inflight-bytes
+// is set.
+func (h *httpHandler) pushesLimited() bool {
+	return *maxPushSize > 0 || h.budget.max > 0
+}
+
+// bufferResult reads the body of a result, which is read through limited,
+// into memory. A result exceeding the limits then fails its
+// scrape with the reason before Prometheus got any of it.
+func bufferResult(result *http.Response, limited *pushBody) error {
+	body, err := io.ReadAll(result.Body)
+	result.Body.Close()
+	if rejected := limited.rejected(); rejected != nil {
+		return rejected
+	}
+	if err != nil {
+		return err
+	}
+	result.Body = io.NopCloser(bytes.NewReader(body))
+	result.ContentLength = int64(len(body))
+	return nil
+}
+
+// limitResult applies the limits of pushes to a result received over a
+// connection, e.g. a stream, reading it into memory. The returned body must
+// be released once the result was read.
+func (h *httpHandler) limitResult(result *http.Response) (*pushBody, error) {
+	limited := newPushBody(result.Body, result.ContentLength, h.budget, int64(*maxPushSize))
+	limited.startResults()
+	result.Body = limited
+	if err := limited.rejected(); err != nil {
+		return limited, err
+	}
+	return limited, bufferResult(result, limited)
+}
+
+// failResult fails the scrape a rejected result is for with err.
+func (h *httpHandler) failResult(result *http.Response, err error) error {
+	result.Body.Close()
+	msg := err.Error() + "\n"
+	return h.coordinator.ScrapeResult(&http.Response{
+		StatusCode: pushStatus(err),
+		Header: http.Header{
+			"Id":           {result.Header.Get("Id")},
+			"Content-Type": {"text/plain; charset=utf-8"},
+		},
+		Body:          io.NopCloser(strings.NewReader(msg)),
+		ContentLength: int64(len(msg)),
+	})
+}
@@ -0,0 +1,215 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/prometheus-community/pushprox/util"
+)
+
+func TestByteBudget(t *testing.T) {
+	b := newByteBudget(100)
+	if !b.acquire(60) {
+		t.Fatal("Expected 60 bytes to fit")
+	}
+	if b.acquire(50) {
+		t.Fatal("Expected 110 bytes to exceed the budget")
+	}
+	b.release(60)
+	if !b.acquire(100) {
+		t.Fatal("Expected the budget to be free again")
+	}
+	b.release(100)
+	if got := testutil.ToFloat64(inflightPushBytes); got != 0 {
+		t.Errorf("Expected no bytes in flight, got %v", got)
+	}
+}
+
+func TestPushTooLarge(t *testing.T) {
+	*maxPushSize = 1 << 10
+	defer func() { *maxPushSize = 0 }()
+	ts, c := newProtocolTestProxy(t)
+	defer ts.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	scraped := make(chan *http.Response, 1)
+	go func() {
+		r, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://client.example.com/metrics", nil)
+		resp, err := c.DoScrape(ctx, r)
+		if err != nil {
+			t.Error(err)
+		}
+		scraped <- resp
+	}()
+	r := pollScrape(t, ts.URL)
+
+	result := &http.Response{
+		StatusCode:    http.StatusOK,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Id": {r.Header.Get("Id")}},
+		Body:          io.NopCloser(strings.NewReader(strings.Repeat("a 1\n", 1<<10))),
+		ContentLength: 4 << 10,
+	}
+	buf := &bytes.Buffer{}
+	result.Write(buf)
+	push, err := http.Post(ts.URL+"/push", "", buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	push.Body.Close()
+	if push.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected the push to be rejected as too large, got %s", push.Status)
+	}
+
+	resp := <-scraped
+	if resp == nil {
+		t.FailNow()
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusRequestEntityTooLarge || !strings.Contains(string(body), "--push.max-size") {
+		t.Errorf("Expected the scrape to fail with the reason, got %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestPushOverBudget(t *testing.T) {
+	*maxInflightPushBytes = 16 << 10
+	defer func() { *maxInflightPushBytes = 0 }()
+	ts, _ := newProtocolTestProxy(t)
+	defer ts.Close()
+	proxyURL, _ := url.Parse(ts.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	type scrape struct {
+		status int
+		body   string
+		err    error
+	}
+	scraped := make(chan scrape, 1)
+	go func() {
+		req, _ := http.NewRequest(http.MethodGet, "http://client.example.com/metrics", nil)
+		req.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", "5")
+		resp, err := client.Do(req)
+		if err != nil {
+			scraped <- scrape{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		scraped <- scrape{resp.StatusCode, string(body), err}
+	}()
+
+	// A result of unknown size, exceeding the budget before Prometheus gets
+	// any of it.
+	pw, status := startStreamedPush(t, ts.URL)
+	go func() {
+		defer pw.Close()
+		for range 100 {
+			if _, err := io.WriteString(pw, strings.Repeat("a 1\n", 64)); err != nil {
+				return
+			}
+		}
+	}()
+	if code := <-status; code != http.StatusServiceUnavailable {
+		t.Errorf("Expected the push to be rejected as over budget, got %d", code)
+	}
+	if got := <-scraped; got.err != nil || got.status != http.StatusServiceUnavailable || !strings.Contains(got.body, "--push.max-inflight-bytes") {
+		t.Errorf("Expected the scrape to fail with the reason, got %d %q: %v", got.status, got.body, got.err)
+	}
+	if got := testutil.ToFloat64(inflightPushBytes); got != 0 {
+		t.Errorf("Expected the budget to be released, got %v bytes in flight", got)
+	}
+}
+
+func TestStreamResultTooLarge(t *testing.T) {
+	*maxPushSize = 1 << 10
+	defer func() { *maxPushSize = 0 }()
+	ts, c := newProtocolTestProxy(t)
+	defer ts.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	req, err := util.NewStreamRequest(ctx, ts.URL+"/stream", util.Poll{FQDN: "client.example.com", Version: util.ProtocolVersion}, pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Body.Close()
+	fr := util.NewFrameReader(stream.Body)
+	fw := util.NewFrameWriter(pw, nil)
+	nextScrape := func() *http.Request {
+		_, payload, err := fr.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(payload)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+
+	scraped := make(chan *http.Response, 1)
+	go func() {
+		r, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://client.example.com/metrics", nil)
+		resp, err := c.DoScrape(ctx, r)
+		if err != nil {
+			t.Error(err)
+		}
+		scraped <- resp
+	}()
+	// A result of unknown size, exceeding the limit before Prometheus gets
+	// any of it.
+	r := nextScrape()
+	result := &http.Response{
+		StatusCode:    http.StatusOK,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Id": {r.Header.Get("Id")}},
+		Body:          io.NopCloser(strings.NewReader(strings.Repeat("a 1\n", 1<<10))),
+		ContentLength: -1,
+	}
+	buf := &bytes.Buffer{}
+	result.Write(buf)
+	go fw.WriteFrame(util.FrameScrapeResponse, buf.Bytes()) //nolint:errcheck
+	resp := <-scraped
+	if resp == nil {
+		t.FailNow()
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusRequestEntityTooLarge || !strings.Contains(string(body), "--push.max-size") {
+		t.Errorf("Expected the scrape to fail with the reason, got %d %q", resp.StatusCode, body)
+	}
+
+	// The stream is still usable.
+	results := queueScrapes(ctx, c, 1)
+	r = nextScrape()
+	go fw.WriteFrame(util.FrameScrapeResponse, scrapeResult(t, r)) //nolint:errcheck
+	if got := <-results; got != r.URL.Path {
+		t.Errorf("Expected the result of the next scrape, got %q", got)
+	}
+}
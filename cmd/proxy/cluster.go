@@ -0,0 +1,257 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	clusterPeers        = kingpin.Flag("cluster.peer", "URL of another proxy replica. Scrapes of clients polling another replica are forwarded to it. Can be repeated.").Strings()
+	clusterSyncInterval = kingpin.Flag("cluster.sync-interval", "How often to fetch the clients of the other replicas.").Default("10s").Duration()
+	clusterSharding     = kingpin.Flag("cluster.sharding", "Assign clients to replicas by consistent hashing of their FQDN, redirecting clients polling another replica.").Bool()
+	clusterAdvertiseURL = kingpin.Flag("cluster.advertise-url", "URL under which the other replicas reach this one, as passed to their --cluster.peer. Required for sharding.").String()
+)
+
+// forwardedHeader marks scrapes forwarded by another replica, which must not
+// be forwarded again.
+const forwardedHeader = "X-Pushprox-Forwarded"
+
+var (
+	clusterForwarded = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "cluster_forwarded_scrapes_total",
+			Help:      "Number of scrapes forwarded to other replicas.",
+		}, []string{"peer"},
+	)
+	clusterPeerUp = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "cluster_peer_up",
+			Help:      "Whether the last sync with a replica succeeded.",
+		}, []string{"peer"},
+	)
+)
+
+// registration is a client polling a replica.
+type registration struct {
+	FQDN     string    `json:"fqdn"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+type peer struct {
+	url    *url.URL
+	client *http.Client
+}
+
+// cluster tracks which clients are polling which of the other replicas.
+// With sharding, clients are instead assigned to replicas by a hash ring.
+type cluster struct {
+	peers []*peer
+	// Set when sharding.
+	self string
+
+	mu sync.Mutex
+	// Peer a client last polled, and when.
+	owners map[string]ownerInfo
+	// Ring of this replica and the peers which are up, set when sharding.
+	ring *hashRing
+
+	logger *slog.Logger
+}
+
+type ownerInfo struct {
+	peer     *peer
+	lastSeen time.Time
+}
+
+func newCluster(peerURLs []string, logger *slog.Logger) (*cluster, error) {
+	cl := &cluster{owners: map[string]ownerInfo{}, logger: logger}
+	for _, p := range peerURLs {
+		u, err := url.Parse(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid peer URL %q: %w", p, err)
+		}
+		// Peers are proxies themselves, so scrapes can be sent through them
+		// unchanged.
+		cl.peers = append(cl.peers, &peer{
+			url: u,
+			client: &http.Client{Transport: &http.Transport{
+				Proxy: http.ProxyURL(u),
+			}},
+		})
+	}
+	if *clusterSharding {
+		if *clusterAdvertiseURL == "" {
+			return nil, fmt.Errorf("--cluster.advertise-url is required for sharding")
+		}
+		self, err := url.Parse(*clusterAdvertiseURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid advertise URL %q: %w", *clusterAdvertiseURL, err)
+		}
+		// All replicas must build the same ring, which is why the
+		// advertised URL has to match the peer URLs used by the others.
+		cl.self = self.String()
+		cl.ring = cl.newRing(cl.peers)
+	}
+	return cl, nil
+}
+
+// newRing returns the hash ring of this replica and peers.
+func (cl *cluster) newRing(peers []*peer) *hashRing {
+	members := []string{cl.self}
+	for _, p := range peers {
+		members = append(members, p.url.String())
+	}
+	return newHashRing(members)
+}
+
+// run periodically syncs the registrations of all peers.
+func (cl *cluster) run(ctx context.Context) {
+	ticker := time.NewTicker(*clusterSyncInterval)
+	defer ticker.Stop()
+	for {
+		cl.sync(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (cl *cluster) sync(ctx context.Context) {
+	owners := map[string]ownerInfo{}
+	var up []*peer
+	limit := time.Now().Add(-*registrationTimeout)
+	for _, p := range cl.peers {
+		regs, err := cl.fetchRegistrations(ctx, p)
+		if err != nil {
+			cl.logger.Warn("Failed to sync with peer", "peer", p.url.String(), "err", err)
+			clusterPeerUp.WithLabelValues(p.url.String()).Set(0)
+			continue
+		}
+		clusterPeerUp.WithLabelValues(p.url.String()).Set(1)
+		up = append(up, p)
+		for _, r := range regs {
+			if r.LastSeen.Before(limit) {
+				continue
+			}
+			// A client switching replicas may briefly be known by both.
+			if o, ok := owners[r.FQDN]; !ok || o.lastSeen.Before(r.LastSeen) {
+				owners[r.FQDN] = ownerInfo{peer: p, lastSeen: r.LastSeen}
+			}
+		}
+	}
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	cl.owners = owners
+	if cl.self != "" {
+		// The clients of peers which are down are served by the others
+		// until they are back.
+		cl.ring = cl.newRing(up)
+	}
+}
+
+func (cl *cluster) fetchRegistrations(ctx context.Context, p *peer) ([]registration, error) {
+	ctx, cancel := context.WithTimeout(ctx, *clusterSyncInterval)
+	defer cancel()
+	u := p.url.ResolveReference(&url.URL{Path: "/cluster/registrations"})
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	// Talk to the peer directly, not through it.
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	var regs []registration
+	if err := json.NewDecoder(resp.Body).Decode(&regs); err != nil {
+		return nil, err
+	}
+	return regs, nil
+}
+
+// owner returns the other replica responsible for a client, if any.
+func (cl *cluster) owner(fqdn string) (*peer, bool) {
+	if cl == nil {
+		return nil, false
+	}
+	if cl.self != "" {
+		return cl.shardOwner(fqdn)
+	}
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	o, ok := cl.owners[fqdn]
+	return o.peer, ok
+}
+
+// shardOwner returns the replica a client is assigned to, unless it is this
+// one.
+func (cl *cluster) shardOwner(fqdn string) (*peer, bool) {
+	if cl == nil || cl.self == "" {
+		return nil, false
+	}
+	cl.mu.Lock()
+	owner := cl.ring.get(fqdn)
+	cl.mu.Unlock()
+	if owner == cl.self {
+		return nil, false
+	}
+	for _, p := range cl.peers {
+		if p.url.String() == owner {
+			return p, true
+		}
+	}
+	return nil, false
+}
+
+// clients returns the clients polling other replicas.
+func (cl *cluster) clients() []string {
+	if cl == nil {
+		return nil
+	}
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	clients := make([]string, 0, len(cl.owners))
+	for k := range cl.owners {
+		clients = append(clients, k)
+	}
+	sort.Strings(clients)
+	return clients
+}
+
+// forward sends a scrape to the peer the client is polling.
+func (cl *cluster) forward(p *peer, r *http.Request) (*http.Response, error) {
+	clusterForwarded.WithLabelValues(p.url.String()).Inc()
+	r.Header.Set(forwardedHeader, "1")
+	return p.client.Do(r)
+}
@@ -0,0 +1,152 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/promslog"
+)
+
+func newTestReplica(t *testing.T, cl *cluster) (*memoryCoordinator, *httptest.Server) {
+	t.Helper()
+	c, err := NewMemoryCoordinator(promslog.NewNopLogger(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(newHTTPHandler(promslog.NewNopLogger(), c, nil, cl, http.NewServeMux()))
+	t.Cleanup(ts.Close)
+	return c, ts
+}
+
+func TestClusterForwarding(t *testing.T) {
+	*registrationTimeout = 5 * time.Minute
+	*maxScrapeTimeout = time.Minute
+	*defaultScrapeTimeout = 10 * time.Second
+	*clusterSyncInterval = 10 * time.Second
+
+	owner, ownerServer := newTestReplica(t, nil)
+	cl, err := newCluster([]string{ownerServer.URL}, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, server := newTestReplica(t, cl)
+
+	// A client polling the owning replica.
+	owner.addKnownClient("client.example.com")
+	go func() {
+		req, err := owner.WaitForScrapeInstruction(context.Background(), "client.example.com")
+		if err != nil {
+			return
+		}
+		resp := &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Id": {req.Header.Get("Id")}},
+			Body:       io.NopCloser(strings.NewReader("metrics")),
+		}
+		owner.ScrapeResult(resp)
+	}()
+
+	cl.sync(context.Background())
+	if got := cl.clients(); len(got) != 1 || got[0] != "client.example.com" {
+		t.Fatalf("Expected client of peer to be known, got %v", got)
+	}
+
+	proxyURL, _ := url.Parse(server.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	resp, err := client.Get("http://client.example.com:9100/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "metrics" {
+		t.Errorf("Expected forwarded scrape to succeed, got %s: %q", resp.Status, body)
+	}
+}
+
+func TestPollRedirect(t *testing.T) {
+	*clusterSharding = true
+	*clusterAdvertiseURL = "http://self.example.com:8080/"
+	defer func() { *clusterSharding = false; *clusterAdvertiseURL = "" }()
+	cl, err := newCluster([]string{"http://peer.example.com:8080/"}, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, server := newTestReplica(t, cl)
+	// A client assigned to the peer.
+	fqdn := ""
+	for i := 0; fqdn == ""; i++ {
+		if k := fmt.Sprintf("client-%d.example.com", i); cl.ring.get(k) == "http://peer.example.com:8080/" {
+			fqdn = k
+		}
+	}
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Post(server.URL+"/poll", "", strings.NewReader(fqdn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTemporaryRedirect {
+		t.Fatalf("Expected the poll to be redirected, got %s", resp.Status)
+	}
+	if got, want := resp.Header.Get("Location"), "http://peer.example.com:8080/poll"; got != want {
+		t.Errorf("Expected redirect to %s, got %s", want, got)
+	}
+}
+
+func TestShardingSkipsDownPeers(t *testing.T) {
+	*registrationTimeout = 5 * time.Minute
+	*clusterSyncInterval = 10 * time.Second
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("[]"))
+	}))
+	defer up.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	*clusterSharding = true
+	*clusterAdvertiseURL = "http://self.example.com:8080/"
+	defer func() { *clusterSharding = false; *clusterAdvertiseURL = "" }()
+	cl, err := newCluster([]string{up.URL + "/", down.URL + "/"}, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cl.sync(context.Background())
+	owners := map[string]int{}
+	for i := range 100 {
+		p, ok := cl.shardOwner(fmt.Sprintf("client-%d.example.com", i))
+		if !ok {
+			owners[cl.self]++
+			continue
+		}
+		owners[p.url.String()]++
+	}
+	if owners[down.URL+"/"] != 0 {
+		t.Errorf("Expected no clients to be assigned to the peer which is down, got %v", owners)
+	}
+	if owners[up.URL+"/"] == 0 || owners[cl.self] == 0 {
+		t.Errorf("Expected clients to be shared by the others, got %v", owners)
+	}
+}
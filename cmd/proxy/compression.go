@@ -0,0 +1,110 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/prometheus-community/pushprox/util"
+)
+
+var (
+	resultBytes = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "result_bytes_total",
+			Help:      "Bytes of scrape results received from clients, by Content-Encoding.",
+		}, []string{"encoding"},
+	)
+	decompressionOutputBytes = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "decompression_output_bytes_total",
+			Help:      "Bytes of scrape results after decompressing them for Prometheus, by the encoding received.",
+		}, []string{"encoding"},
+	)
+)
+
+// countingBody counts the bytes read from a body into a counter.
+type countingBody struct {
+	io.ReadCloser
+	counter prometheus.Counter
+}
+
+func (b countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.counter.Add(float64(n))
+	return n, err
+}
+
+// acceptsEncoding returns whether an Accept-Encoding header accepts encoding.
+func acceptsEncoding(header []string, encoding string) bool {
+	for _, h := range header {
+		for _, entry := range strings.Split(h, ",") {
+			name, params, _ := strings.Cut(entry, ";")
+			name = strings.TrimSpace(name)
+			if name != encoding && name != "*" {
+				continue
+			}
+			q, ok := strings.CutPrefix(strings.TrimSpace(params), "q=")
+			if !ok {
+				return true
+			}
+			if v, err := strconv.ParseFloat(q, 64); err != nil || v > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// encodeResult adapts a result received from a client to the encodings the
+// scrape accepts. Compressed results are passed through if possible, and
+// recompressed or decompressed otherwise.
+func encodeResult(resp *http.Response, acceptEncoding []string) error {
+	encoding := resp.Header.Get("Content-Encoding")
+	label := encoding
+	if label == "" {
+		label = "identity"
+	}
+	resp.Body = countingBody{ReadCloser: resp.Body, counter: resultBytes.WithLabelValues(label)}
+	if !util.IsSupportedEncoding(encoding) || acceptsEncoding(acceptEncoding, encoding) {
+		// Passed on as is, so its uncompressed size stays unknown.
+		return nil
+	}
+
+	body, err := util.Decompress(resp.Body, encoding)
+	if err != nil {
+		return err
+	}
+	resp.Body = countingBody{ReadCloser: body, counter: decompressionOutputBytes.WithLabelValues(encoding)}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	for _, other := range []string{util.EncodingGzip, util.EncodingZstd} {
+		if other != encoding && acceptsEncoding(acceptEncoding, other) {
+			if resp.Body, err = util.Compress(resp.Body, other, nil); err != nil {
+				return err
+			}
+			resp.Header.Set("Content-Encoding", other)
+			break
+		}
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/prometheus-community/pushprox/util"
+)
+
+func TestAcceptsEncoding(t *testing.T) {
+	for _, tc := range []struct {
+		header   []string
+		encoding string
+		want     bool
+	}{
+		{nil, "gzip", false},
+		{[]string{"gzip"}, "gzip", true},
+		{[]string{"gzip"}, "zstd", false},
+		{[]string{"zstd;q=1.0, gzip;q=0.5"}, "zstd", true},
+		{[]string{"gzip", "zstd"}, "zstd", true},
+		{[]string{"zstd;q=0"}, "zstd", false},
+		{[]string{"*"}, "zstd", true},
+	} {
+		if got := acceptsEncoding(tc.header, tc.encoding); got != tc.want {
+			t.Errorf("acceptsEncoding(%q, %q) = %v, want %v", tc.header, tc.encoding, got, tc.want)
+		}
+	}
+}
+
+func TestEncodeResult(t *testing.T) {
+	const metrics = "up 1\n"
+	for _, tc := range []struct {
+		name     string
+		encoding string
+		accept   []string
+		want     string
+	}{
+		{"pass through", util.EncodingZstd, []string{"zstd, gzip"}, util.EncodingZstd},
+		{"recompress", util.EncodingZstd, []string{"gzip"}, util.EncodingGzip},
+		{"decompress", util.EncodingGzip, nil, ""},
+		{"uncompressed", "", []string{"gzip"}, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			body := io.NopCloser(strings.NewReader(metrics))
+			if tc.encoding != "" {
+				compressed, err := util.Compress(body, tc.encoding, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				raw, _ := io.ReadAll(compressed)
+				body = io.NopCloser(strings.NewReader(string(raw)))
+			}
+			resp := &http.Response{Header: http.Header{}, Body: body}
+			if tc.encoding != "" {
+				resp.Header.Set("Content-Encoding", tc.encoding)
+			}
+
+			if err := encodeResult(resp, tc.accept); err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			got := resp.Header.Get("Content-Encoding")
+			if got != tc.want {
+				t.Fatalf("Expected encoding %q, got %q", tc.want, got)
+			}
+			if got != "" {
+				decompressed, err := util.Decompress(resp.Body, got)
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp.Body = decompressed
+			}
+			if b, _ := io.ReadAll(resp.Body); string(b) != metrics {
+				t.Errorf("Expected %q, got %q", metrics, b)
+			}
+		})
+	}
+}
@@ -26,10 +26,14 @@ import (
 	"github.com/prometheus-community/pushprox/util"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var (
-	registrationTimeout = kingpin.Flag("registration.timeout", "After how long a registration expires.").Default("5m").Duration()
+	registrationTimeout   = kingpin.Flag("registration.timeout", "After how long a registration expires.").Default("5m").Duration()
+	registrationRetention = kingpin.Flag("registration.retention", "How long to keep reporting a client as down after its registration expired.").Default("1h").Duration()
 )
 
 // Coordinator metrics.
@@ -41,28 +45,124 @@ var (
 			Help:      "Number of known pushprox clients.",
 		},
 	)
+	clientUp = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "client_up",
+			Help:      "Whether a pushprox client has polled within the registration timeout.",
+		}, []string{"fqdn"},
+	)
+	scrapesQueued = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "scrapes_queued",
+			Help:      "Number of scrapes on this replica waiting for their client to poll. Only tracked with the memory coordinator.",
+		},
+	)
 )
 
-// Coordinator for scrape requests and responses
-type Coordinator struct {
+// Coordinator for scrape requests and responses. It tracks the known
+// clients, hands scrapes to polling clients and their results back to the
+// waiting scrapes.
+type Coordinator interface {
+	// DoScrape hands a scrape to the polling client and waits for its result.
+	DoScrape(ctx context.Context, r *http.Request) (*http.Response, error)
+	// WaitForScrapeInstruction registers a client and waits for a scrape for it.
+	WaitForScrapeInstruction(ctx context.Context, fqdn string) (*http.Request, error)
+	// NextScrapeInstruction returns a scrape already waiting for a client
+	// without blocking, or nil if there is none.
+	NextScrapeInstruction(ctx context.Context, fqdn string) (*http.Request, error)
+	// ScrapeResult hands the result of a scrape to the waiting DoScrape.
+	ScrapeResult(r *http.Response) error
+	// Deregister forgets a client which is shutting down.
+	Deregister(fqdn string) error
+
+	// KnownClients returns the clients which polled within the registration
+	// timeout.
+	KnownClients() []string
+	// StaleClients returns the clients whose registration expired, but which
+	// are still within the registration retention.
+	StaleClients() []string
+	// IsKnown returns whether a client polled within the registration timeout.
+	IsKnown(fqdn string) bool
+	// Registrations returns the known clients and when they last polled.
+	Registrations() []registration
+
+	// RecordScrape remembers a scrape of a known client.
+	RecordScrape(fqdn string, r scrapeRecord)
+	// ScrapeHistory returns the recent scrapes of a client, oldest first. The
+	// second return value is false if the client is not known.
+	ScrapeHistory(fqdn string) ([]scrapeRecord, bool)
+}
+
+// leftClients tracks the clients which deregistered. Their client_up series
+// is kept at 0 until the registration retention expires, like that of clients
+// which stopped polling, so that alerts see them go down rather than vanish.
+type leftClients struct {
+	mu    sync.Mutex
+	since map[string]time.Time
+}
+
+// add marks fqdn as having left at now.
+func (l *leftClients) add(fqdn string, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.since == nil {
+		l.since = map[string]time.Time{}
+	}
+	l.since[fqdn] = now
+	clientUp.WithLabelValues(fqdn).Set(0)
+}
+
+// remove forgets that fqdn left, as it came back.
+func (l *leftClients) remove(fqdn string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.since, fqdn)
+}
+
+// expire deletes the series of the clients which left before limit.
+func (l *leftClients) expire(limit time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for k, ts := range l.since {
+		if ts.Before(limit) {
+			delete(l.since, k)
+			clientUp.DeleteLabelValues(k)
+		}
+	}
+}
+
+// memoryCoordinator is a Coordinator keeping all state in memory. Clients
+// have to poll the replica that Prometheus scrapes.
+type memoryCoordinator struct {
 	mu sync.Mutex
 
 	// Clients waiting for a scrape.
 	waiting map[string]chan *http.Request
 	// Responses from clients.
 	responses map[string]chan *http.Response
-	// Clients we know about and when they last contacted us.
+	// Clients we know about and when they last contacted us. Entries are
+	// kept until the registration retention expires.
 	known map[string]time.Time
+	// Recent scrapes of known clients.
+	history map[string]*scrapeHistory
+	left    leftClients
+	// When clients were last garbage collected.
+	lastGC time.Time
 
+	audit  *util.AuditLog
 	logger *slog.Logger
 }
 
-// NewCoordinator initiates the coordinator and starts the client cleanup routine
-func NewCoordinator(logger *slog.Logger) (*Coordinator, error) {
-	c := &Coordinator{
+// NewMemoryCoordinator initiates the coordinator and starts the client cleanup routine
+func NewMemoryCoordinator(logger *slog.Logger, audit *util.AuditLog) (*memoryCoordinator, error) {
+	c := &memoryCoordinator{
 		waiting:   map[string]chan *http.Request{},
 		responses: map[string]chan *http.Response{},
 		known:     map[string]time.Time{},
+		history:   map[string]*scrapeHistory{},
+		audit:     audit,
 		logger:    logger,
 	}
 
@@ -71,12 +171,12 @@ func NewCoordinator(logger *slog.Logger) (*Coordinator, error) {
 }
 
 // Generate a unique ID
-func (c *Coordinator) genID() (string, error) {
+func genID() (string, error) {
 	id, err := uuid.NewRandom()
 	return id.String(), err
 }
 
-func (c *Coordinator) getRequestChannel(fqdn string) chan *http.Request {
+func (c *memoryCoordinator) getRequestChannel(fqdn string) chan *http.Request {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	ch, ok := c.waiting[fqdn]
@@ -87,69 +187,101 @@ func (c *Coordinator) getRequestChannel(fqdn string) chan *http.Request {
 	return ch
 }
 
-func (c *Coordinator) getResponseChannel(id string) chan *http.Response {
+func (c *memoryCoordinator) addResponseChannel(id string) chan *http.Response {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	ch, ok := c.responses[id]
-	if !ok {
-		ch = make(chan *http.Response)
-		c.responses[id] = ch
-	}
+	ch := make(chan *http.Response)
+	c.responses[id] = ch
 	return ch
 }
 
+func (c *memoryCoordinator) getResponseChannel(id string) (chan *http.Response, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch, ok := c.responses[id]
+	return ch, ok
+}
+
 // Remove a response channel. Idempotent.
-func (c *Coordinator) removeResponseChannel(id string) {
+func (c *memoryCoordinator) removeResponseChannel(id string) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	delete(c.responses, id)
 }
 
 // DoScrape requests a scrape.
-func (c *Coordinator) DoScrape(ctx context.Context, r *http.Request) (*http.Response, error) {
-	id, err := c.genID()
+func (c *memoryCoordinator) DoScrape(ctx context.Context, r *http.Request) (*http.Response, error) {
+	id, err := genID()
 	if err != nil {
 		return nil, err
 	}
 	c.logger.Info("DoScrape", "scrape_id", id, "url", r.URL.String())
 	r.Header.Add("Id", id)
+	// Continue the trace on the client.
+	util.InjectTraceContext(ctx, r.Header)
+	_, span := tracer.Start(ctx, "queue", trace.WithAttributes(attribute.String("scrape_id", id)))
+	// Ready for the result before anyone can send it.
+	respCh := c.addResponseChannel(id)
+	defer c.removeResponseChannel(id)
+	fqdn := r.URL.Hostname()
+	scrapesQueued.Inc()
 	select {
 	case <-ctx.Done():
+		scrapesQueued.Dec()
+		span.SetStatus(codes.Error, "no client polled")
+		span.End()
 		return nil, fmt.Errorf("timeout reached for %q: %s", r.URL.String(), ctx.Err())
-	case c.getRequestChannel(r.URL.Hostname()) <- r:
+	case c.getRequestChannel(fqdn) <- r:
 	}
+	scrapesQueued.Dec()
+	span.End()
 
-	respCh := c.getResponseChannel(id)
-	defer c.removeResponseChannel(id)
-
+	_, span = tracer.Start(ctx, "wait for result", trace.WithAttributes(attribute.String("scrape_id", id)))
+	defer span.End()
 	select {
 	case <-ctx.Done():
+		span.SetStatus(codes.Error, ctx.Err().Error())
 		return nil, ctx.Err()
 	case resp := <-respCh:
 		return resp, nil
 	}
 }
 
-// WaitForScrapeInstruction registers a client waiting for a scrape result
-func (c *Coordinator) WaitForScrapeInstruction(fqdn string) (*http.Request, error) {
+// WaitForScrapeInstruction registers a client waiting for a scrape result.
+// A client may have several polls waiting at once; scrapes are handed to
+// them in the order they started waiting.
+func (c *memoryCoordinator) WaitForScrapeInstruction(ctx context.Context, fqdn string) (*http.Request, error) {
 	c.logger.Info("WaitForScrapeInstruction", "fqdn", fqdn)
 
 	c.addKnownClient(fqdn)
-	// TODO: What if the client times out?
+	// Receivers of a channel are served first in, first out.
 	ch := c.getRequestChannel(fqdn)
+	for {
+		var request *http.Request
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case request = <-ch:
+		}
 
-	// exhaust existing poll request (eg. timeouted queues)
-	select {
-	case ch <- nil:
-		//
-	default:
-		break
+		select {
+		case <-request.Context().Done():
+			// Request has timed out, get another one.
+		default:
+			return request, nil
+		}
 	}
+}
 
+// NextScrapeInstruction returns a scrape already waiting for fqdn, if any.
+func (c *memoryCoordinator) NextScrapeInstruction(ctx context.Context, fqdn string) (*http.Request, error) {
+	ch := c.getRequestChannel(fqdn)
 	for {
-		request := <-ch
-		if request == nil {
-			return nil, fmt.Errorf("request is expired")
+		var request *http.Request
+		select {
+		case request = <-ch:
+		default:
+			return nil, nil
 		}
 
 		select {
@@ -162,33 +294,63 @@ func (c *Coordinator) WaitForScrapeInstruction(fqdn string) (*http.Request, erro
 }
 
 // ScrapeResult send by client
-func (c *Coordinator) ScrapeResult(r *http.Response) error {
+func (c *memoryCoordinator) ScrapeResult(r *http.Response) error {
 	id := r.Header.Get("Id")
 	c.logger.Info("ScrapeResult", "scrape_id", id)
+	respCh, ok := c.getResponseChannel(id)
+	if !ok {
+		// The scrape timed out, or never existed.
+		return fmt.Errorf("no scrape waiting for result %q", id)
+	}
 	ctx, cancel := context.WithTimeout(context.Background(), util.GetScrapeTimeout(maxScrapeTimeout, defaultScrapeTimeout, r.Header))
 	defer cancel()
 	// Don't expose internal headers.
 	r.Header.Del("Id")
 	r.Header.Del("X-Prometheus-Scrape-Timeout-Seconds")
 	select {
-	case c.getResponseChannel(id) <- r:
+	case respCh <- r:
 		return nil
 	case <-ctx.Done():
-		c.removeResponseChannel(id)
 		return ctx.Err()
 	}
 }
 
-func (c *Coordinator) addKnownClient(fqdn string) {
+func (c *memoryCoordinator) addKnownClient(fqdn string) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	c.known[fqdn] = time.Now()
-	knownClients.Set(float64(len(c.known)))
+	now := time.Now()
+	if ts, ok := c.known[fqdn]; !ok || ts.Before(now.Add(-*registrationTimeout)) {
+		// New client, or one coming back after its registration expired.
+		knownClients.Inc()
+		c.audit.Log(auditEntry{Timestamp: now, Event: auditRegister, FQDN: fqdn})
+	}
+	c.known[fqdn] = now
+	c.left.remove(fqdn)
+	clientUp.WithLabelValues(fqdn).Set(1)
+}
+
+// Deregister forgets a client right away, rather than having it expire, and
+// marks it as left.
+func (c *memoryCoordinator) Deregister(fqdn string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ts, ok := c.known[fqdn]
+	if !ok {
+		return nil
+	}
+	if time.Now().Add(-*registrationTimeout).Before(ts) {
+		knownClients.Dec()
+	}
+	delete(c.known, fqdn)
+	delete(c.history, fqdn)
+	c.left.add(fqdn, time.Now())
+	c.audit.Log(auditEntry{Timestamp: time.Now(), Event: auditDeregister, FQDN: fqdn})
+	return nil
 }
 
 // KnownClients returns a list of alive clients
-func (c *Coordinator) KnownClients() []string {
+func (c *memoryCoordinator) KnownClients() []string {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
@@ -202,22 +364,113 @@ func (c *Coordinator) KnownClients() []string {
 	return known
 }
 
+// IsKnown returns whether a client polled within the registration timeout.
+func (c *memoryCoordinator) IsKnown(fqdn string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t, ok := c.known[fqdn]
+	return ok && time.Now().Add(-*registrationTimeout).Before(t)
+}
+
+// Registrations returns the alive clients and when they last polled.
+func (c *memoryCoordinator) Registrations() []registration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	limit := time.Now().Add(-*registrationTimeout)
+	regs := make([]registration, 0, len(c.known))
+	for k, t := range c.known {
+		if limit.Before(t) {
+			regs = append(regs, registration{FQDN: k, LastSeen: t})
+		}
+	}
+	return regs
+}
+
+// StaleClients returns a list of clients whose registration expired, but
+// which are still within the registration retention.
+func (c *memoryCoordinator) StaleClients() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	limit := time.Now().Add(-*registrationTimeout)
+	stale := make([]string, 0)
+	for k, t := range c.known {
+		if !limit.Before(t) {
+			stale = append(stale, k)
+		}
+	}
+	return stale
+}
+
+// RecordScrape remembers a scrape of a known client.
+func (c *memoryCoordinator) RecordScrape(fqdn string, r scrapeRecord) {
+	if *scrapeHistorySize <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.known[fqdn]; !ok {
+		return
+	}
+	h, ok := c.history[fqdn]
+	if !ok {
+		h = newScrapeHistory(*scrapeHistorySize)
+		c.history[fqdn] = h
+	}
+	h.add(r)
+}
+
+// ScrapeHistory returns the recent scrapes of a client, oldest first. The
+// second return value is false if the client is not known.
+func (c *memoryCoordinator) ScrapeHistory(fqdn string) ([]scrapeRecord, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.known[fqdn]; !ok {
+		return nil, false
+	}
+	h, ok := c.history[fqdn]
+	if !ok {
+		return []scrapeRecord{}, true
+	}
+	return h.list(), true
+}
+
 // Garbagee collect old clients.
-func (c *Coordinator) gc() {
+func (c *memoryCoordinator) gc() {
 	for range time.Tick(1 * time.Minute) {
-		func() {
-			c.mu.Lock()
-			defer c.mu.Unlock()
-			limit := time.Now().Add(-*registrationTimeout)
-			deleted := 0
-			for k, ts := range c.known {
-				if ts.Before(limit) {
-					delete(c.known, k)
-					deleted++
-				}
+		c.expire(time.Now())
+	}
+}
+
+// expire marks clients whose registration timed out as down and forgets
+// clients which are past the registration retention.
+func (c *memoryCoordinator) expire(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	limit := now.Add(-*registrationTimeout)
+	prevLimit := c.lastGC.Add(-*registrationTimeout)
+	retentionLimit := now.Add(-max(*registrationTimeout, *registrationRetention))
+	deleted, stale := 0, 0
+	for k, ts := range c.known {
+		switch {
+		case ts.Before(retentionLimit):
+			delete(c.known, k)
+			delete(c.history, k)
+			clientUp.DeleteLabelValues(k)
+			c.audit.Log(auditEntry{Timestamp: now, Event: auditForget, FQDN: k})
+			deleted++
+		case ts.Before(limit):
+			clientUp.WithLabelValues(k).Set(0)
+			if !ts.Before(prevLimit) {
+				// Expired since the last run.
+				c.audit.Log(auditEntry{Timestamp: now, Event: auditExpire, FQDN: k})
 			}
-			c.logger.Info("GC of clients completed", "deleted", deleted, "remaining", len(c.known))
-			knownClients.Set(float64(len(c.known)))
-		}()
+			stale++
+		}
 	}
+	c.left.expire(retentionLimit)
+	c.lastGC = now
+	c.logger.Info("GC of clients completed", "deleted", deleted, "stale", stale, "remaining", len(c.known))
+	knownClients.Set(float64(len(c.known) - stale))
 }
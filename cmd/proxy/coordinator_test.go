@@ -0,0 +1,144 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/promslog"
+)
+
+func TestClientExpiry(t *testing.T) {
+	*registrationTimeout = 5 * time.Minute
+	*registrationRetention = time.Hour
+	clientUp.Reset()
+	c, err := NewMemoryCoordinator(promslog.NewNopLogger(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.addKnownClient("alive")
+	c.addKnownClient("stale")
+	c.addKnownClient("gone")
+	c.mu.Lock()
+	c.known["stale"] = time.Now().Add(-*registrationTimeout - time.Minute)
+	c.known["gone"] = time.Now().Add(-*registrationRetention - time.Minute)
+	c.mu.Unlock()
+
+	c.expire(time.Now())
+
+	if known := c.KnownClients(); len(known) != 1 || known[0] != "alive" {
+		t.Errorf("Expected [alive], got %v", known)
+	}
+	if stale := c.StaleClients(); len(stale) != 1 || stale[0] != "stale" {
+		t.Errorf("Expected [stale], got %v", stale)
+	}
+	if v := testutil.ToFloat64(clientUp.WithLabelValues("alive")); v != 1 {
+		t.Errorf("Expected alive client to be up, got %v", v)
+	}
+	if v := testutil.ToFloat64(clientUp.WithLabelValues("stale")); v != 0 {
+		t.Errorf("Expected stale client to be down, got %v", v)
+	}
+	if n := testutil.CollectAndCount(clientUp); n != 2 {
+		t.Errorf("Expected 2 client_up series, got %d", n)
+	}
+	if v := testutil.ToFloat64(knownClients); v != 1 {
+		t.Errorf("Expected 1 known client, got %v", v)
+	}
+}
+
+func TestDeregister(t *testing.T) {
+	*registrationTimeout = 5 * time.Minute
+	*registrationRetention = time.Hour
+	clientUp.Reset()
+	c, err := NewMemoryCoordinator(promslog.NewNopLogger(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.addKnownClient("client.example.com")
+	if err := c.Deregister("client.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if known := c.KnownClients(); len(known) != 0 {
+		t.Errorf("Expected no known clients, got %v", known)
+	}
+	if stale := c.StaleClients(); len(stale) != 0 {
+		t.Errorf("Expected deregistered client not to be stale, got %v", stale)
+	}
+	if v := testutil.ToFloat64(clientUp.WithLabelValues("client.example.com")); v != 0 {
+		t.Errorf("Expected deregistered client to be down, got %v", v)
+	}
+
+	c.expire(time.Now().Add(*registrationRetention + time.Minute))
+	if n := testutil.CollectAndCount(clientUp); n != 0 {
+		t.Errorf("Expected the series of the client to be gone after the retention, got %d series", n)
+	}
+}
+
+func TestConcurrentPolls(t *testing.T) {
+	*registrationTimeout = 5 * time.Minute
+	c, err := NewMemoryCoordinator(promslog.NewNopLogger(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	const pollers = 3
+	got := make(chan *http.Request, pollers)
+	for range pollers {
+		go func() {
+			r, err := c.WaitForScrapeInstruction(ctx, "client.example.com")
+			if err != nil {
+				t.Error(err)
+			}
+			got <- r
+		}()
+		// A new poll must not cut short the ones already waiting.
+		time.Sleep(10 * time.Millisecond)
+	}
+	for range pollers {
+		go func() {
+			r, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://client.example.com/metrics", nil)
+			c.DoScrape(ctx, r) //nolint:errcheck // Nobody pushes a result.
+		}()
+	}
+
+	ids := map[string]bool{}
+	for range pollers {
+		r := <-got
+		if r == nil {
+			t.Fatal("Expected every poll to get a scrape")
+		}
+		ids[r.Header.Get("Id")] = true
+	}
+	if len(ids) != pollers {
+		t.Errorf("Expected %d distinct scrapes, got %d", pollers, len(ids))
+	}
+}
+
+func TestScrapeResultWithoutScrape(t *testing.T) {
+	c, err := NewMemoryCoordinator(promslog.NewNopLogger(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Rather than holding up the client until the scrape timeout.
+	resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Id": {"unknown"}}}
+	if err := c.ScrapeResult(resp); err == nil {
+		t.Error("Expected a result nobody waits for to fail")
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// drainer lets in-flight scrapes finish on shutdown, while turning away new
+// scrapes and polls.
+type drainer struct {
+	mu       sync.RWMutex
+	inflight sync.WaitGroup
+	// Closed when draining starts.
+	draining chan struct{}
+	// Closed when draining is over.
+	drained chan struct{}
+}
+
+func newDrainer() *drainer {
+	return &drainer{
+		draining: make(chan struct{}),
+		drained:  make(chan struct{}),
+	}
+}
+
+// begin registers an in-flight scrape, unless draining already started. Each
+// successful begin must be followed by a call to end.
+func (d *drainer) begin() bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.isDraining() {
+		return false
+	}
+	d.inflight.Add(1)
+	return true
+}
+
+func (d *drainer) end() {
+	d.inflight.Done()
+}
+
+func (d *drainer) isDraining() bool {
+	select {
+	case <-d.draining:
+		return true
+	default:
+		return false
+	}
+}
+
+// drain waits for the in-flight scrapes to finish, or ctx to be done.
+func (d *drainer) drain(ctx context.Context) error {
+	d.mu.Lock()
+	close(d.draining)
+	d.mu.Unlock()
+	defer close(d.drained)
+
+	done := make(chan struct{})
+	go func() {
+		d.inflight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus-community/pushprox/util"
+)
+
+func TestDrain(t *testing.T) {
+	*registrationTimeout = 5 * time.Minute
+	*maxScrapeTimeout = time.Minute
+	*defaultScrapeTimeout = 10 * time.Second
+	ts, c := newProtocolTestProxy(t)
+	defer ts.Close()
+	h := ts.Config.Handler.(*httpHandler)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// A scrape queued while the client is between polls, which holds up
+	// draining.
+	if !h.drainer.begin() {
+		t.Fatal("Expected to be able to start a scrape")
+	}
+	results := queueScrapes(ctx, c, 1)
+	waitForQueued(t, 1)
+	drained := make(chan error)
+	go func() {
+		drained <- h.Drain(context.Background())
+	}()
+
+	// The next poll still gets it.
+	r := pollScrape(t, ts.URL)
+	push, err := http.Post(ts.URL+"/push", "", bytes.NewReader(scrapeResult(t, r)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	push.Body.Close()
+	if got := <-results; got != "/0" {
+		t.Errorf("Expected the queued scrape to succeed while draining, got %q", got)
+	}
+
+	proxyURL, _ := url.Parse(ts.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	resp, err := client.Get("http://client.example.com:9100/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected new scrapes to be rejected, got %s", resp.Status)
+	}
+
+	polled := make(chan *http.Response)
+	go func() {
+		resp, err := http.Post(ts.URL+"/poll", "", strings.NewReader("client.example.com"))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		resp.Body.Close()
+		polled <- resp
+	}()
+	select {
+	case <-drained:
+		t.Fatal("Expected draining to wait for the in-flight scrape")
+	case <-polled:
+		t.Fatal("Expected the poll to wait until drained")
+	case <-time.After(50 * time.Millisecond):
+	}
+	h.drainer.end()
+	if err := <-drained; err != nil {
+		t.Fatal(err)
+	}
+	resp = <-polled
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get(util.ReconnectHeader) == "" {
+		t.Errorf("Expected parked poll to be asked to reconnect, got %s", resp.Status)
+	}
+}
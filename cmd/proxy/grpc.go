@@ -0,0 +1,226 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	grpcpeer "google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"github.com/prometheus-community/pushprox/pushproxpb"
+	"github.com/prometheus-community/pushprox/util"
+)
+
+var (
+	grpcMaxRecvMsgSize = kingpin.Flag("grpc.max-recv-msg-size", "Maximum size of a message received from gRPC clients, i.e. of a single scrape result. Clients sending larger messages are disconnected.").Default("16MiB").Bytes()
+)
+
+var (
+	openGRPCStreams = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "grpc_streams",
+			Help:      "Number of clients connected via gRPC.",
+		},
+	)
+)
+
+// isGRPC returns whether r is a gRPC call rather than an HTTP API request.
+func isGRPC(r *http.Request) bool {
+	return r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+// newGRPCServer returns the gRPC service, served next to the HTTP API.
+func newGRPCServer(h *httpHandler) *grpc.Server {
+	s := grpc.NewServer(grpc.MaxRecvMsgSize(int(*grpcMaxRecvMsgSize)))
+	pushproxpb.RegisterPushProxServer(s, &grpcServer{h: h})
+	return s
+}
+
+// grpcServer implements the PushProx gRPC service on top of the HTTP API.
+type grpcServer struct {
+	pushproxpb.UnimplementedPushProxServer
+	h *httpHandler
+}
+
+// Connect handles clients exchanging scrapes and their results over a gRPC
+// stream, like handleStream.
+func (s *grpcServer) Connect(stream pushproxpb.PushProx_ConnectServer) error {
+	msg, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	fqdn := strings.TrimSpace(msg.GetHello().GetFqdn())
+	if fqdn == "" {
+		return status.Error(codes.InvalidArgument, "expected a hello with the FQDN of the client")
+	}
+	if p, ok := s.h.cluster.shardOwner(fqdn); ok {
+		s.h.logger.Debug("Redirecting Connect", "fqdn", fqdn, "location", p.url.String())
+		stream.SetTrailer(metadata.Pairs(util.RedirectMetadata, p.url.String()))
+		return status.Error(codes.Unavailable, "client is served by another replica")
+	}
+	if s.h.drainer.isDraining() {
+		select {
+		case <-s.h.drainer.drained:
+			stream.SetTrailer(metadata.Pairs(util.ReconnectMetadata, "1"))
+			return status.Error(codes.Unavailable, "proxy is shutting down")
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		}
+	}
+	openGRPCStreams.Inc()
+	defer openGRPCStreams.Dec()
+	s.h.limits.update(fqdn, int(msg.GetHello().GetScrapeLimit()))
+	if p, ok := grpcpeer.FromContext(stream.Context()); ok {
+		var certs []*x509.Certificate
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			certs = info.State.PeerCertificates
+		}
+		s.h.identities.bind(fqdn, connIdentity(p.Addr.String(), certs))
+	}
+	// Tells the client it is connected.
+	if err := stream.SendHeader(metadata.MD{}); err != nil {
+		return err
+	}
+
+	s.h.logger.Info("Opened gRPC stream", "fqdn", fqdn)
+	s.h.serveScrapes(stream.Context(), fqdn, grpcScrapeConn{stream})
+	s.h.logger.Info("Closed gRPC stream", "fqdn", fqdn)
+	return nil
+}
+
+// grpcScrapeConn carries scrapes and results as protobuf messages.
+type grpcScrapeConn struct {
+	stream pushproxpb.PushProx_ConnectServer
+}
+
+func (c grpcScrapeConn) SendScrape(r *http.Request) error {
+	timeout := util.GetScrapeTimeout(maxScrapeTimeout, defaultScrapeTimeout, r.Header)
+	if deadline, ok := r.Context().Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+	return c.stream.Send(util.NewScrapeInstruction(r, timeout))
+}
+
+func (c grpcScrapeConn) ReadResult() (*http.Response, error) {
+	for {
+		msg, err := c.stream.Recv()
+		if err != nil {
+			return nil, err
+		}
+		if result := msg.GetResult(); result != nil {
+			return util.ReadScrapeResult(result), nil
+		}
+	}
+}
+
+// ListClients lists the known clients, as /clients does.
+func (s *grpcServer) ListClients(_ context.Context, req *pushproxpb.ListClientsRequest) (*pushproxpb.ListClientsResponse, error) {
+	resp := &pushproxpb.ListClientsResponse{}
+	for _, k := range s.h.knownClients() {
+		resp.Clients = append(resp.Clients, &pushproxpb.Client{Fqdn: k})
+	}
+	if req.GetStale() {
+		for _, k := range s.h.coordinator.StaleClients() {
+			resp.Clients = append(resp.Clients, &pushproxpb.Client{Fqdn: k, Stale: true})
+		}
+	}
+	return resp, nil
+}
+
+// Scrape scrapes a target as if Prometheus had asked us to, with the
+// deadline of the call as the scrape timeout.
+func (s *grpcServer) Scrape(ctx context.Context, req *pushproxpb.ScrapeRequest) (*pushproxpb.ScrapeResult, error) {
+	u, err := url.Parse(req.GetUrl())
+	if err != nil || u.Host == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid target URL %q", req.GetUrl())
+	}
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	r.Header = util.HeadersFromProto(req.GetHeaders())
+	// The deadline of the call is the scrape timeout.
+	r.Header.Del("X-Prometheus-Scrape-Timeout-Seconds")
+	if p, ok := grpcpeer.FromContext(ctx); ok {
+		r.RemoteAddr = p.Addr.String()
+	}
+	w := &responseBuffer{header: http.Header{}}
+	if !serveAbortable(s.h.proxy, w, r) {
+		return nil, status.Error(codes.Unavailable, "scrape result was cut short")
+	}
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if err := ctx.Err(); errors.Is(err, context.DeadlineExceeded) {
+		return nil, status.Error(codes.DeadlineExceeded, err.Error())
+	}
+	return util.NewScrapeResult(&http.Response{
+		StatusCode: w.status,
+		Header:     w.header,
+		Body:       io.NopCloser(&w.body),
+	})
+}
+
+// serveAbortable serves r, returning false if the handler aborted the
+// response with http.ErrAbortHandler.
+func serveAbortable(h http.Handler, w http.ResponseWriter, r *http.Request) (ok bool) {
+	defer func() {
+		if p := recover(); p != nil {
+			if p != http.ErrAbortHandler {
+				panic(p)
+			}
+			ok = false
+		}
+	}()
+	h.ServeHTTP(w, r)
+	return true
+}
+
+// responseBuffer keeps the response written by a handler.
+type responseBuffer struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *responseBuffer) Header() http.Header {
+	return w.header
+}
+
+func (w *responseBuffer) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *responseBuffer) Write(b []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(b)
+}
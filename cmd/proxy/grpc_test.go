@@ -0,0 +1,124 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/promslog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+
+	"github.com/prometheus-community/pushprox/pushproxpb"
+	"github.com/prometheus-community/pushprox/util"
+)
+
+func TestGRPC(t *testing.T) {
+	*registrationTimeout = 5 * time.Minute
+	*maxScrapeTimeout = time.Minute
+	*defaultScrapeTimeout = 10 * time.Second
+	*grpcMaxRecvMsgSize = 16 << 20
+	c, err := NewMemoryCoordinator(promslog.NewNopLogger(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newHTTPHandler(promslog.NewNopLogger(), c, nil, nil, http.NewServeMux())
+	// Served next to the HTTP API, as in main.
+	ts := httptest.NewUnstartedServer(h)
+	ts.Config.Protocols = &http.Protocols{}
+	ts.Config.Protocols.SetHTTP1(true)
+	ts.Config.Protocols.SetUnencryptedHTTP2(true)
+	ts.Start()
+	defer ts.Close()
+
+	conn, err := grpc.NewClient(ts.Listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := pushproxpb.NewPushProxClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stream, err := client.Connect(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hello := &pushproxpb.Hello{Fqdn: "client.example.com"}
+	if err := stream.Send(&pushproxpb.ClientMessage{Message: &pushproxpb.ClientMessage_Hello{Hello: hello}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Header(); err != nil {
+		t.Fatal(err)
+	}
+	// The client answers every scrape with its path, and the scrape of /1
+	// with a result larger than the default gRPC message limit.
+	large := "/1" + strings.Repeat("x", 5<<20)
+	go func() {
+		for {
+			instruction, err := stream.Recv()
+			if err != nil {
+				return
+			}
+			path := instruction.GetUrl()[len("http://client.example.com"):]
+			limit := *maxScrapeTimeout
+			if path == "/metrics" {
+				// Scraped with a 2s deadline.
+				limit = 2 * time.Second
+			}
+			if d := instruction.GetTimeout().AsDuration(); d <= 0 || d > limit {
+				t.Errorf("Expected a scrape timeout of at most %s, got %s", limit, d)
+			}
+			body := []byte(path)
+			if path == "/1" {
+				body = []byte(large)
+			}
+			result := &pushproxpb.ScrapeResult{Id: instruction.GetId(), StatusCode: http.StatusOK, Body: body}
+			stream.Send(&pushproxpb.ClientMessage{Message: &pushproxpb.ClientMessage_Result{Result: result}})
+		}
+	}()
+
+	results := queueScrapes(ctx, c, 2)
+	got := map[string]bool{<-results: true, <-results: true}
+	if !got["/0"] || !got[large] {
+		t.Errorf("Expected the results of both scrapes, got %v", got)
+	}
+
+	clients, err := client.ListClients(ctx, &pushproxpb.ListClientsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(clients.GetClients()) != 1 || clients.GetClients()[0].GetFqdn() != "client.example.com" {
+		t.Errorf("Expected client.example.com to be listed, got %v", clients.GetClients())
+	}
+
+	scrapeCtx, scrapeCancel := context.WithTimeout(ctx, 2*time.Second)
+	defer scrapeCancel()
+	// The deadline of the call wins over the timeout in a header.
+	headers := util.HeadersToProto(http.Header{"X-Prometheus-Scrape-Timeout-Seconds": {"50"}})
+	result, err := client.Scrape(scrapeCtx, &pushproxpb.ScrapeRequest{Url: "http://client.example.com/metrics", Headers: headers})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := util.ReadScrapeResult(result)
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "/metrics" {
+		t.Errorf("Expected the scrape to succeed, got %d: %q", resp.StatusCode, body)
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+)
+
+var (
+	scrapeHistorySize = kingpin.Flag("scrape.history-size", "Number of recent scrapes to remember per client, 0 to disable.").Default("20").Int()
+)
+
+// scrapeRecord describes a single proxied scrape.
+type scrapeRecord struct {
+	Timestamp time.Time `json:"timestamp"`
+	ScrapeID  string    `json:"scrape_id"`
+	Source    string    `json:"source"`
+	URL       string    `json:"url"`
+	Status    int       `json:"status"`
+	Duration  float64   `json:"duration_seconds"`
+	Bytes     int64     `json:"bytes"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// scrapeHistory is a fixed size ring buffer of scrape records.
+type scrapeHistory struct {
+	records []scrapeRecord
+	next    int
+	full    bool
+}
+
+func newScrapeHistory(size int) *scrapeHistory {
+	return &scrapeHistory{records: make([]scrapeRecord, size)}
+}
+
+func (h *scrapeHistory) add(r scrapeRecord) {
+	h.records[h.next] = r
+	h.next = (h.next + 1) % len(h.records)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// list returns the records from oldest to newest.
+func (h *scrapeHistory) list() []scrapeRecord {
+	if !h.full {
+		return append([]scrapeRecord{}, h.records[:h.next]...)
+	}
+	return append(append([]scrapeRecord{}, h.records[h.next:]...), h.records[:h.next]...)
+}
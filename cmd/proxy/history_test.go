@@ -0,0 +1,37 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+)
+
+func TestScrapeHistory(t *testing.T) {
+	h := newScrapeHistory(3)
+	if l := h.list(); len(l) != 0 {
+		t.Fatalf("Expected empty history, got %v", l)
+	}
+	for i := range 5 {
+		h.add(scrapeRecord{Status: i})
+	}
+	l := h.list()
+	if len(l) != 3 {
+		t.Fatalf("Expected 3 records, got %d", len(l))
+	}
+	for i, r := range l {
+		if r.Status != i+2 {
+			t.Errorf("Expected record %d to have status %d, got %d", i, i+2, r.Status)
+		}
+	}
+}
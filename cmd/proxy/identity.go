@@ -0,0 +1,81 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"crypto/x509"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// clientIdentities remembers the identity each client last connected with,
+// so that only the client itself can deregister.
+type clientIdentities struct {
+	mu  sync.Mutex
+	ids map[string]string
+}
+
+func newClientIdentities() *clientIdentities {
+	return &clientIdentities{ids: map[string]string{}}
+}
+
+// bind records that fqdn connected with identity id.
+func (c *clientIdentities) bind(fqdn, id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ids[fqdn] = id
+}
+
+// owns returns whether fqdn last connected with identity id.
+func (c *clientIdentities) owns(fqdn, id string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	bound, ok := c.ids[fqdn]
+	return ok && bound == id
+}
+
+func (c *clientIdentities) remove(fqdn string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.ids, fqdn)
+}
+
+// clientIdentity returns the identity a client makes a request with: that of
+// its TLS client certificate, or else its address. Headers are never used, as
+// the proxy can't tell who set them.
+func clientIdentity(r *http.Request) string {
+	var certs []*x509.Certificate
+	if r.TLS != nil {
+		certs = r.TLS.PeerCertificates
+	}
+	return connIdentity(r.RemoteAddr, certs)
+}
+
+// connIdentity returns the identity of a client connecting from addr with the
+// given TLS certificates, if any.
+func connIdentity(addr string, certs []*x509.Certificate) string {
+	if len(certs) > 0 {
+		return certs[0].Subject.CommonName
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// certFor returns whether r carries a TLS client certificate issued for fqdn.
+func certFor(r *http.Request, fqdn string) bool {
+	return r.TLS != nil && len(r.TLS.PeerCertificates) > 0 && r.TLS.PeerCertificates[0].VerifyHostname(fqdn) == nil
+}
@@ -0,0 +1,96 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	scrapesRejected = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "scrapes_rejected_total",
+			Help:      "Number of scrapes rejected because the client had as many scrapes in flight as it accepts.",
+		},
+	)
+)
+
+// errClientBusy is returned for scrapes beyond the limit advertised by a client.
+var errClientBusy = errors.New("client has too many scrapes in flight")
+
+// clientLimits tracks the scrapes in flight per client, for clients which
+// advertise how many scrapes they accept at once.
+type clientLimits struct {
+	mu     sync.Mutex
+	limits map[string]*clientLimit
+}
+
+type clientLimit struct {
+	max      int // 0 for no limit.
+	inflight int
+}
+
+func newClientLimits() *clientLimits {
+	return &clientLimits{limits: map[string]*clientLimit{}}
+}
+
+// update sets the limit of fqdn advertised on its poll, 0 for none.
+func (l *clientLimits) update(fqdn string, n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	c, ok := l.limits[fqdn]
+	if !ok {
+		if n == 0 {
+			return
+		}
+		c = &clientLimit{}
+		l.limits[fqdn] = c
+	}
+	c.max = n
+	l.cleanup(fqdn, c)
+}
+
+// acquire reserves a scrape of fqdn. It returns false if fqdn has as many
+// scrapes in flight as it accepts, and otherwise a func releasing the scrape.
+// Scrapes are counted even without a limit, so that they count against a limit
+// advertised while they are in flight.
+func (l *clientLimits) acquire(fqdn string) (func(), bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	c, ok := l.limits[fqdn]
+	if !ok {
+		c = &clientLimit{}
+		l.limits[fqdn] = c
+	}
+	if c.max > 0 && c.inflight >= c.max {
+		return nil, false
+	}
+	c.inflight++
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		c.inflight--
+		l.cleanup(fqdn, c)
+	}, true
+}
+
+func (l *clientLimits) cleanup(fqdn string, c *clientLimit) {
+	if c.max == 0 && c.inflight == 0 {
+		delete(l.limits, fqdn)
+	}
+}
@@ -0,0 +1,57 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"testing"
+)
+
+func TestClientLimits(t *testing.T) {
+	l := newClientLimits()
+	acquire := func(fqdn string) func() {
+		t.Helper()
+		release, ok := l.acquire(fqdn)
+		if !ok {
+			t.Fatalf("Expected a scrape of %s to be accepted", fqdn)
+		}
+		return release
+	}
+	releaseA1, releaseA2 := acquire("a"), acquire("a")
+
+	// Scrapes in flight before the client advertised a limit count against it.
+	l.update("a", 2)
+	if _, ok := l.acquire("a"); ok {
+		t.Fatal("Expected a scrape beyond the limit to be rejected")
+	}
+	releaseA1()
+	releaseA3 := acquire("a")
+	releaseA2()
+	releaseA3()
+
+	l.update("a", 1)
+	releaseA := acquire("a")
+	if _, ok := l.acquire("a"); ok {
+		t.Fatal("Expected a scrape beyond the limit to be rejected")
+	}
+	acquire("b")()
+	releaseA()
+	releaseA = acquire("a")
+
+	// The client no longer advertises a limit.
+	l.update("a", 0)
+	acquire("a")()
+	releaseA()
+	if len(l.limits) != 0 {
+		t.Errorf("Expected no clients to be tracked, got %d", len(l.limits))
+	}
+}
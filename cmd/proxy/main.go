@@ -14,36 +14,58 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log/slog"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/alecthomas/kingpin/v2"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/prometheus/common/promslog"
 	"github.com/prometheus/common/promslog/flag"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/prometheus-community/pushprox/util"
 )
 
 const (
 	namespace = "pushprox_proxy" // For Prometheus metrics.
+
+	// staleLabel marks targets in /clients whose registration expired.
+	staleLabel = "__meta_pushprox_stale"
 )
 
 var (
 	listenAddress        = kingpin.Flag("web.listen-address", "Address to listen on for proxy and client requests.").Default(":8080").String()
+	coordinatorBackend   = kingpin.Flag("coordinator", "Where to keep clients and scrapes: in memory, or in Redis shared by all replicas.").Default("memory").Enum("memory", "redis")
+	shutdownTimeout      = kingpin.Flag("web.shutdown-timeout", "How long to wait for in-flight scrapes to finish on shutdown.").Default("30s").Duration()
 	maxScrapeTimeout     = kingpin.Flag("scrape.max-timeout", "Any scrape with a timeout higher than this will have to be clamped to this.").Default("5m").Duration()
 	defaultScrapeTimeout = kingpin.Flag("scrape.default-timeout", "If a scrape lacks a timeout, use this value.").Default("15s").Duration()
+
+	tracingEndpoint     = kingpin.Flag("tracing.endpoint", "OTLP/HTTP endpoint (host:port) to export traces to. Tracing is disabled if empty.").String()
+	tracingInsecure     = kingpin.Flag("tracing.insecure", "Export traces without TLS.").Bool()
+	tracingSamplingRate = kingpin.Flag("tracing.sampling-rate", "Fraction of scrapes without a sampled parent trace to trace.").Default("1").Float64()
 )
 
+var tracer = otel.Tracer("github.com/prometheus-community/pushprox/cmd/proxy")
+
 var (
 	httpAPICounter = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
@@ -69,12 +91,12 @@ func init() {
 	prometheus.MustRegister(httpAPICounter, httpProxyCounter, httpPathHistogram)
 }
 
-func copyHTTPResponse(resp *http.Response, w http.ResponseWriter) {
+func copyHTTPResponse(resp *http.Response, w http.ResponseWriter) (int64, error) {
 	for k, v := range resp.Header {
 		w.Header()[k] = v
 	}
 	w.WriteHeader(resp.StatusCode)
-	io.Copy(w, resp.Body)
+	return io.Copy(w, resp.Body)
 }
 
 type targetGroup struct {
@@ -84,20 +106,38 @@ type targetGroup struct {
 
 type httpHandler struct {
 	logger      *slog.Logger
-	coordinator *Coordinator
+	coordinator Coordinator
+	audit       *util.AuditLog
+	cluster     *cluster
+	drainer     *drainer
+	limits      *clientLimits
+	identities  *clientIdentities
+	budget      *byteBudget
 	mux         http.Handler
 	proxy       http.Handler
+	grpc        http.Handler
+
+	// Set once the proxy is listening and its state is loaded.
+	ready atomic.Bool
 }
 
-func newHTTPHandler(logger *slog.Logger, coordinator *Coordinator, mux *http.ServeMux) *httpHandler {
-	h := &httpHandler{logger: logger, coordinator: coordinator, mux: mux}
+func newHTTPHandler(logger *slog.Logger, coordinator Coordinator, audit *util.AuditLog, cl *cluster, mux *http.ServeMux) *httpHandler {
+	h := &httpHandler{logger: logger, coordinator: coordinator, audit: audit, cluster: cl, drainer: newDrainer(), limits: newClientLimits(), identities: newClientIdentities(), budget: newByteBudget(int64(*maxInflightPushBytes)), mux: mux}
 
 	// api handlers
 	handlers := map[string]http.HandlerFunc{
-		"/push":    h.handlePush,
-		"/poll":    h.handlePoll,
-		"/clients": h.handleListClients,
-		"/metrics": promhttp.Handler().ServeHTTP,
+		"/push":       h.handlePush,
+		"/poll":       h.handlePoll,
+		"/stream":     h.handleStream,
+		"/websocket":  h.handleWebSocket,
+		"/deregister": h.handleDeregister,
+		"/clients":    h.handleListClients,
+		"/metrics":    promhttp.Handler().ServeHTTP,
+		"/-/healthy":  h.handleHealthy,
+		"/-/ready":    h.handleReady,
+
+		"/api/v1/clients/{fqdn}/scrapes": h.handleScrapeHistory,
+		"/cluster/registrations":         h.handleRegistrations,
 	}
 	for path, handlerFunc := range handlers {
 		counter := httpAPICounter.MustCurryWith(prometheus.Labels{"path": path})
@@ -116,49 +156,243 @@ func newHTTPHandler(logger *slog.Logger, coordinator *Coordinator, mux *http.Ser
 
 	// proxy handler
 	h.proxy = promhttp.InstrumentHandlerCounter(httpProxyCounter, http.HandlerFunc(h.handleProxy))
+	h.grpc = newGRPCServer(h)
 
 	return h
 }
 
 // handlePush handles scrape responses from client.
 func (h *httpHandler) handlePush(w http.ResponseWriter, r *http.Request) {
-	buf := &bytes.Buffer{}
-	io.Copy(buf, r.Body)
-	scrapeResult, err := http.ReadResponse(bufio.NewReader(buf), nil)
+	pushBody := newPushBody(r.Body, r.ContentLength, h.budget, int64(*maxPushSize))
+	defer pushBody.release()
+	r.Body = pushBody
+	scrapeResults, err := util.ReadPush(r)
+	pushBody.startResults()
+	if rejected := pushBody.rejected(); rejected != nil {
+		h.rejectPush(w, scrapeResults, rejected)
+		return
+	}
 	if err != nil {
 		h.logger.Error("Error reading pushed response:", "err", err)
 		http.Error(w, fmt.Sprintf("Error pushing: %s", err.Error()), 500)
 		return
 	}
-	scrapeId := scrapeResult.Header.Get("Id")
-	h.logger.Info("Got /push", "scrape_id", scrapeId)
-	err = h.coordinator.ScrapeResult(scrapeResult)
-	if err != nil {
-		h.logger.Error("Error pushing:", "err", err, "scrape_id", scrapeId)
-		http.Error(w, fmt.Sprintf("Error pushing: %s", err.Error()), 500)
+	streamed := util.IsStreamedPush(r)
+	if streamed && r.ContentLength < 0 && h.pushesLimited() {
+		// Learn whether the result is within the limits before the scrape
+		// gets any of it, so that it can fail with the reason otherwise.
+		if err := bufferResult(scrapeResults[0], pushBody); err != nil {
+			if rejected := pushBody.rejected(); rejected != nil {
+				h.rejectPush(w, scrapeResults, rejected)
+				return
+			}
+			h.logger.Error("Error reading pushed response:", "err", err)
+			http.Error(w, fmt.Sprintf("Error pushing: %s", err.Error()), 500)
+			return
+		}
+	}
+	var errs []error
+	for _, scrapeResult := range scrapeResults {
+		scrapeId := scrapeResult.Header.Get("Id")
+		h.logger.Info("Got /push", "scrape_id", scrapeId)
+		var body *pushedBody
+		if streamed {
+			body = newPushedBody(scrapeResult.Body)
+			scrapeResult.Body = body
+		}
+		// Keep going, other results of a batch are still awaited.
+		if err := h.coordinator.ScrapeResult(scrapeResult); err != nil {
+			h.logger.Error("Error pushing:", "err", err, "scrape_id", scrapeId)
+			errs = append(errs, err)
+			continue
+		}
+		if body != nil {
+			// The result is read from the push as the scrape copies it.
+			if err := body.wait(r.Context()); err != nil {
+				if rejected := pushBody.rejected(); rejected != nil {
+					err = rejected
+				}
+				h.logger.Warn("Error streaming result:", "err", err, "scrape_id", scrapeId)
+				errs = append(errs, err)
+				// Rather than reading the rest of the result.
+				w.Header().Set("Connection", "close")
+			}
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		http.Error(w, fmt.Sprintf("Error pushing: %s", err.Error()), pushStatus(err))
 	}
 }
 
+// rejectPush fails the scrapes of a push rejected by its size or the budget.
+func (h *httpHandler) rejectPush(w http.ResponseWriter, scrapeResults []*http.Response, err error) {
+	h.logger.Warn("Rejected push:", "err", err)
+	for _, scrapeResult := range scrapeResults {
+		if ferr := h.failResult(scrapeResult, err); ferr != nil {
+			h.logger.Error("Error failing scrape:", "err", ferr, "scrape_id", scrapeResult.Header.Get("Id"))
+		}
+	}
+	// Rather than reading the rest of the push.
+	w.Header().Set("Connection", "close")
+	http.Error(w, fmt.Sprintf("Error pushing: %s", err.Error()), pushStatus(err))
+}
+
 // handlePoll handles clients registering and asking for scrapes.
 func (h *httpHandler) handlePoll(w http.ResponseWriter, r *http.Request) {
-	fqdn, _ := io.ReadAll(r.Body)
-	request, err := h.coordinator.WaitForScrapeInstruction(strings.TrimSpace(string(fqdn)))
+	poll, err := util.DecodePoll(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error reading poll: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+	fqdn := poll.FQDN
+	if h.redirectToOwner(w, r, fqdn, "poll") {
+		return
+	}
+	resp := negotiate(poll)
+	h.limits.update(fqdn, resp.Capabilities[util.CapabilityScrapeLimit])
+	h.identities.bind(fqdn, clientIdentity(r))
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	// While draining, scrapes queued before still need a poll to take them.
+	go func() {
+		select {
+		case <-h.drainer.drained:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	request, err := h.coordinator.WaitForScrapeInstruction(ctx, fqdn)
+	if err != nil && h.drainer.isDraining() {
+		h.reconnect(w)
+		return
+	}
 	if err != nil {
 		h.logger.Info("Error WaitForScrapeInstruction:", "err", err)
 		http.Error(w, fmt.Sprintf("Error WaitForScrapeInstruction: %s", err.Error()), http.StatusRequestTimeout)
 		return
 	}
-	//nolint:errcheck // https://github.com/prometheus-community/PushProx/issues/111
-	request.WriteProxy(w) // Send full request as the body of the response.
-	h.logger.Info("Responded to /poll", "url", request.URL.String(), "scrape_id", request.Header.Get("Id"))
+	resp.Requests = h.nextRequests(ctx, fqdn, request, resp.Capabilities)
+	spans := make([]trace.Span, len(resp.Requests))
+	for i, request := range resp.Requests {
+		_, spans[i] = tracer.Start(request.Context(), "poll delivery", trace.WithAttributes(
+			attribute.String("fqdn", fqdn), attribute.Int("batch_size", len(resp.Requests))))
+	}
+	// Send the full requests as the body of the response.
+	if err := util.WritePollResponse(w, resp); err != nil {
+		h.logger.Warn("Error writing poll response", "fqdn", fqdn, "err", err)
+	}
+	for i, request := range resp.Requests {
+		spans[i].End()
+		h.logger.Info("Responded to /poll", "url", request.URL.String(), "scrape_id", request.Header.Get("Id"))
+	}
+}
+
+// redirectToOwner redirects a client to the replica it is assigned to, if
+// it is not this one.
+func (h *httpHandler) redirectToOwner(w http.ResponseWriter, r *http.Request, fqdn, path string) bool {
+	p, ok := h.cluster.shardOwner(fqdn)
+	if !ok {
+		return false
+	}
+	target := p.url.ResolveReference(&url.URL{Path: path})
+	h.logger.Debug("Redirecting /"+path, "fqdn", fqdn, "location", target.String())
+	http.Redirect(w, r, target.String(), http.StatusTemporaryRedirect)
+	return true
+}
+
+// holdWhileDraining holds a client connecting while we are draining until we
+// are gone, rather than having it connect to us again and again.
+func (h *httpHandler) holdWhileDraining(w http.ResponseWriter, r *http.Request) bool {
+	if !h.drainer.isDraining() {
+		return false
+	}
+	select {
+	case <-h.drainer.drained:
+		h.reconnect(w)
+	case <-r.Context().Done():
+	}
+	return true
+}
+
+// handleDeregister handles clients shutting down. A client can only
+// deregister itself, i.e. with the identity it last connected with, or a TLS
+// client certificate issued for its FQDN.
+func (h *httpHandler) handleDeregister(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	fqdn := strings.TrimSpace(string(body))
+	if !h.identities.owns(fqdn, clientIdentity(r)) && !certFor(r, fqdn) {
+		h.logger.Warn("Refused to deregister another client", "fqdn", fqdn, "identity", clientIdentity(r))
+		http.Error(w, "Clients can only deregister themselves", http.StatusForbidden)
+		return
+	}
+	h.identities.remove(fqdn)
+	if err := h.coordinator.Deregister(fqdn); err != nil {
+		h.logger.Error("Error deregistering:", "err", err, "fqdn", fqdn)
+		http.Error(w, fmt.Sprintf("Error deregistering: %s", err.Error()), 500)
+		return
+	}
+	h.logger.Info("Deregistered client", "fqdn", fqdn)
+}
+
+// reconnect asks a polling client to poll again right away, ideally another
+// replica.
+func (h *httpHandler) reconnect(w http.ResponseWriter) {
+	w.Header().Set(util.ReconnectHeader, "1")
+	http.Error(w, "Proxy is shutting down", http.StatusServiceUnavailable)
+}
+
+// Drain stops accepting scrapes and waits for in-flight scrapes to finish,
+// or ctx to be done. Polling clients are then asked to reconnect.
+func (h *httpHandler) Drain(ctx context.Context) error {
+	return h.drainer.drain(ctx)
+}
+
+// MarkReady marks the proxy as ready to serve clients and scrapes.
+func (h *httpHandler) MarkReady() {
+	h.ready.Store(true)
+}
+
+// handleHealthy handles liveness probes.
+func (h *httpHandler) handleHealthy(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "PushProx Proxy is Healthy.\n")
+}
+
+// handleReady handles readiness probes. The proxy is not ready until it is
+// listening and its state is loaded, nor once it is draining.
+func (h *httpHandler) handleReady(w http.ResponseWriter, r *http.Request) {
+	if !h.ready.Load() || h.drainer.isDraining() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "PushProx Proxy is not Ready.\n")
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "PushProx Proxy is Ready.\n")
 }
 
 // handleListClients handles requests to list available clients as a JSON array.
+// With ?stale=true, clients whose registration expired but which are still
+// retained are included as well, labeled as stale.
 func (h *httpHandler) handleListClients(w http.ResponseWriter, r *http.Request) {
-	known := h.coordinator.KnownClients()
+	known := h.knownClients()
 	targets := make([]*targetGroup, 0, len(known))
+	includeStale := r.URL.Query().Get("stale") == "true"
 	for _, k := range known {
-		targets = append(targets, &targetGroup{Targets: []string{k}})
+		tg := &targetGroup{Targets: []string{k}}
+		if includeStale {
+			tg.Labels = map[string]string{staleLabel: "false"}
+		}
+		targets = append(targets, tg)
+	}
+	if includeStale {
+		for _, k := range h.coordinator.StaleClients() {
+			targets = append(targets, &targetGroup{Targets: []string{k}, Labels: map[string]string{staleLabel: "true"}})
+		}
 	}
 	w.Header().Set("Content-Type", "application/json")
 	//nolint:errcheck // https://github.com/prometheus-community/PushProx/issues/111
@@ -166,27 +400,161 @@ func (h *httpHandler) handleListClients(w http.ResponseWriter, r *http.Request)
 	h.logger.Info("Responded to /clients", "client_count", len(known))
 }
 
+// knownClients returns the clients known to this or any other replica.
+func (h *httpHandler) knownClients() []string {
+	known := h.coordinator.KnownClients()
+	if remote := h.cluster.clients(); len(remote) > 0 {
+		local := make(map[string]struct{}, len(known))
+		for _, k := range known {
+			local[k] = struct{}{}
+		}
+		for _, k := range remote {
+			if _, ok := local[k]; !ok {
+				known = append(known, k)
+			}
+		}
+	}
+	return known
+}
+
 // handleProxy handles proxied scrapes from Prometheus.
 func (h *httpHandler) handleProxy(w http.ResponseWriter, r *http.Request) {
-	ctx, cancel := context.WithTimeout(r.Context(), util.GetScrapeTimeout(maxScrapeTimeout, defaultScrapeTimeout, r.Header))
+	if !h.drainer.begin() {
+		http.Error(w, "Proxy is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	defer h.drainer.end()
+	ctx, span := tracer.Start(util.ExtractTraceContext(r.Context(), r.Header), "proxy scrape",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.String("url", r.URL.String())))
+	defer span.End()
+	ctx, cancel := scrapeContext(ctx, r.Header)
 	defer cancel()
 	request := r.WithContext(ctx)
 	request.RequestURI = ""
+	if _, err := util.GetHeaderTimeout(request.Header); err != nil {
+		// Clients other than gRPC ones learn the timeout from the header.
+		deadline, _ := ctx.Deadline()
+		request.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", strconv.FormatFloat(time.Until(deadline).Seconds(), 'f', -1, 64))
+	}
+
+	record := scrapeRecord{
+		Timestamp: time.Now(),
+		Source:    r.RemoteAddr,
+		URL:       request.URL.String(),
+	}
+	defer func() {
+		record.ScrapeID = request.Header.Get("Id")
+		record.Duration = time.Since(record.Timestamp).Seconds()
+		h.coordinator.RecordScrape(request.URL.Hostname(), record)
+		h.audit.Log(auditEntry{
+			Timestamp: record.Timestamp,
+			Event:     auditScrape,
+			Source:    record.Source,
+			Identity:  requestIdentity(r),
+			User:      claimedUser(r),
+			FQDN:      request.URL.Hostname(),
+			ScrapeID:  record.ScrapeID,
+			URL:       record.URL,
+			Status:    record.Status,
+			Bytes:     record.Bytes,
+			Duration:  record.Duration,
+			Error:     record.Error,
+		})
+	}()
 
-	resp, err := h.coordinator.DoScrape(ctx, request)
+	var resp *http.Response
+	var err error
+	if p, ok := h.forwardTo(request); ok {
+		span.SetAttributes(attribute.String("peer", p.url.String()))
+		resp, err = h.cluster.forward(p, request)
+	} else if release, ok := h.limits.acquire(request.URL.Hostname()); !ok {
+		scrapesRejected.Inc()
+		http.Error(w, fmt.Sprintf("Error scraping %q: %s", request.URL.String(), errClientBusy), http.StatusServiceUnavailable)
+		record.Status = http.StatusServiceUnavailable
+		record.Error = errClientBusy.Error()
+		span.SetStatus(codes.Error, errClientBusy.Error())
+		return
+	} else {
+		defer release()
+		resp, err = h.coordinator.DoScrape(ctx, request)
+		// Forwarded results were adapted by the replica they came from.
+		if err == nil {
+			if err = encodeResult(resp, r.Header.Values("Accept-Encoding")); err != nil {
+				resp.Body.Close()
+			}
+		}
+	}
 	if err != nil {
 		h.logger.Error("Error scraping:", "err", err, "url", request.URL.String())
 		http.Error(w, fmt.Sprintf("Error scraping %q: %s", request.URL.String(), err.Error()), 500)
+		record.Status = 500
+		record.Error = err.Error()
+		span.SetStatus(codes.Error, err.Error())
 		return
 	}
 	defer resp.Body.Close()
-	copyHTTPResponse(resp, w)
+	record.Status = resp.StatusCode
+	span.SetAttributes(attribute.Int("status", resp.StatusCode))
+	record.Bytes, err = copyHTTPResponse(resp, w)
+	if err != nil {
+		record.Error = err.Error()
+		span.SetStatus(codes.Error, err.Error())
+		// Don't let Prometheus take a truncated result for a complete one.
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// scrapeContext bounds a scrape by the timeout Prometheus asks for in h, or
+// else by the deadline ctx already has, e.g. that of a gRPC call, or else by
+// the default timeout. No scrape takes longer than --scrape.max-timeout.
+func scrapeContext(ctx context.Context, h http.Header) (context.Context, context.CancelFunc) {
+	if _, err := util.GetHeaderTimeout(h); err != nil {
+		if deadline, ok := ctx.Deadline(); ok {
+			if limit := time.Now().Add(*maxScrapeTimeout); limit.Before(deadline) {
+				deadline = limit
+			}
+			return context.WithDeadline(ctx, deadline)
+		}
+	}
+	return context.WithTimeout(ctx, util.GetScrapeTimeout(maxScrapeTimeout, defaultScrapeTimeout, h))
+}
+
+// forwardTo returns the replica a scrape should be forwarded to, if any.
+func (h *httpHandler) forwardTo(r *http.Request) (*peer, bool) {
+	fqdn := r.URL.Hostname()
+	if r.Header.Get(forwardedHeader) != "" || h.coordinator.IsKnown(fqdn) {
+		return nil, false
+	}
+	return h.cluster.owner(fqdn)
+}
+
+// handleRegistrations handles requests from other replicas for the clients
+// polling this one.
+func (h *httpHandler) handleRegistrations(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	//nolint:errcheck // https://github.com/prometheus-community/PushProx/issues/111
+	json.NewEncoder(w).Encode(h.coordinator.Registrations())
+}
+
+// handleScrapeHistory handles requests for the recent scrapes of a client.
+func (h *httpHandler) handleScrapeHistory(w http.ResponseWriter, r *http.Request) {
+	records, ok := h.coordinator.ScrapeHistory(r.PathValue("fqdn"))
+	if !ok {
+		http.Error(w, "Unknown client", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	//nolint:errcheck // https://github.com/prometheus-community/PushProx/issues/111
+	json.NewEncoder(w).Encode(records)
 }
 
 // ServeHTTP discriminates between proxy requests (e.g. from Prometheus) and other requests (e.g. from the Client).
 func (h *httpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if r.URL.Host != "" { // Proxy request
 		h.proxy.ServeHTTP(w, r)
+	} else if isGRPC(r) {
+		h.grpc.ServeHTTP(w, r)
 	} else { // Non-proxy requests
 		h.mux.ServeHTTP(w, r)
 	}
@@ -198,18 +566,119 @@ func main() {
 	kingpin.HelpFlag.Short('h')
 	kingpin.Parse()
 	logger := promslog.New(&promslogConfig)
-	coordinator, err := NewCoordinator(logger)
+	shutdownTracing, err := util.SetupTracing(context.Background(), "pushprox-proxy", util.TracingConfig{
+		Endpoint:     *tracingEndpoint,
+		Insecure:     *tracingInsecure,
+		SamplingRate: *tracingSamplingRate,
+	})
+	if err != nil {
+		logger.Error("Tracing initialization failed", "err", err)
+		os.Exit(1)
+	}
+	defer shutdownTracing(context.Background())
+	audit, err := newAuditLogFromFlags(logger)
+	if err != nil {
+		logger.Error("Audit log initialization failed", "err", err)
+		os.Exit(1)
+	}
+	defer audit.Close()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var coordinator Coordinator
+	var memCoordinator *memoryCoordinator
+	switch *coordinatorBackend {
+	case "redis":
+		coordinator, err = NewRedisCoordinator(logger, audit)
+	default:
+		memCoordinator, err = NewMemoryCoordinator(logger, audit)
+		coordinator = memCoordinator
+	}
 	if err != nil {
 		logger.Error("Coordinator initialization failed", "err", err)
 		os.Exit(1)
 	}
+	if memCoordinator != nil && *snapshotFile != "" {
+		// Starting without the previous clients beats not starting at all.
+		if err := memCoordinator.LoadSnapshot(*snapshotFile); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			logger.Warn("Failed to load client snapshot", "err", err, "path", *snapshotFile)
+		}
+		go memCoordinator.runSnapshots(ctx, *snapshotFile)
+	}
+
+	var cl *cluster
+	if len(*clusterPeers) > 0 {
+		cl, err = newCluster(*clusterPeers, logger)
+		if err != nil {
+			logger.Error("Cluster initialization failed", "err", err)
+			os.Exit(1)
+		}
+		go cl.run(ctx)
+	}
 
 	mux := http.NewServeMux()
-	handler := newHTTPHandler(logger, coordinator, mux)
+	handler := newHTTPHandler(logger, coordinator, audit, cl, mux)
+	if *mqttBroker != "" {
+		bridge := newMQTTBridge(handler, logger, *mqttBroker, *mqttClientID, *mqttTopicPrefix)
+		defer bridge.Close()
+	}
 
-	logger.Info("Listening", "address", *listenAddress)
-	if err := http.ListenAndServe(*listenAddress, handler); err != nil {
+	if *sshListenAddress != "" {
+		sshSrv, err := newSSHServer(handler, logger, *sshHostKey, *sshAuthorizedKeys, *sshKeepaliveInterval)
+		if err != nil {
+			logger.Error("SSH server initialization failed", "err", err)
+			os.Exit(1)
+		}
+		sshLn, err := net.Listen("tcp", *sshListenAddress)
+		if err != nil {
+			logger.Error("Listening for SSH failed", "err", err)
+			os.Exit(1)
+		}
+		logger.Info("Listening for SSH", "address", *sshListenAddress)
+		go func() {
+			if err := sshSrv.Serve(sshLn); err != nil {
+				logger.Error("Serving SSH failed", "err", err)
+			}
+		}()
+		defer sshSrv.Close()
+	}
+
+	ln, err := net.Listen("tcp", *listenAddress)
+	if err != nil {
 		logger.Error("Listening failed", "err", err)
 		os.Exit(1)
 	}
+	logger.Info("Listening", "address", *listenAddress)
+	server := &http.Server{Handler: handler, Protocols: &http.Protocols{}}
+	// Clients may open streams over HTTP/2 without TLS.
+	server.Protocols.SetHTTP1(true)
+	server.Protocols.SetUnencryptedHTTP2(true)
+	shutdown := make(chan struct{})
+	go func() {
+		defer close(shutdown)
+		<-ctx.Done()
+		logger.Info("Draining scrapes", "timeout", *shutdownTimeout)
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		defer cancel()
+		// Keep serving pushes for the in-flight scrapes while draining.
+		if err := handler.Drain(shutdownCtx); err != nil {
+			logger.Warn("Not all scrapes finished before the shutdown timeout", "err", err)
+		}
+		logger.Info("Shutting down")
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			server.Close()
+		}
+	}()
+	handler.MarkReady()
+	if err := server.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logger.Error("Serving failed", "err", err)
+		os.Exit(1)
+	}
+	<-shutdown
+
+	if memCoordinator != nil && *snapshotFile != "" {
+		if err := memCoordinator.SaveSnapshot(*snapshotFile); err != nil {
+			logger.Error("Failed to save client snapshot", "err", err, "path", *snapshotFile)
+		}
+	}
 }
@@ -0,0 +1,173 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/promslog"
+)
+
+func TestReadiness(t *testing.T) {
+	c, err := NewMemoryCoordinator(promslog.NewNopLogger(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newHTTPHandler(promslog.NewNopLogger(), c, nil, nil, http.NewServeMux())
+	status := func(path string) int {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w.Code
+	}
+
+	if code := status("/-/healthy"); code != http.StatusOK {
+		t.Errorf("Expected healthy, got %d", code)
+	}
+	if code := status("/-/ready"); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected not ready before start, got %d", code)
+	}
+	h.MarkReady()
+	if code := status("/-/ready"); code != http.StatusOK {
+		t.Errorf("Expected ready, got %d", code)
+	}
+	if err := h.Drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if code := status("/-/ready"); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected not ready while draining, got %d", code)
+	}
+	if code := status("/-/healthy"); code != http.StatusOK {
+		t.Errorf("Expected healthy while draining, got %d", code)
+	}
+}
+
+func TestScrapeHistoryAPI(t *testing.T) {
+	*scrapeHistorySize = 20
+	defer func() { *scrapeHistorySize = 0 }()
+	ts, _ := newProtocolTestProxy(t)
+	defer ts.Close()
+	scraped := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		w := httptest.NewRecorder()
+		ts.Config.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://client.example.com/metrics", nil))
+		scraped <- w
+	}()
+	r := pollScrape(t, ts.URL)
+	push, err := http.Post(ts.URL+"/push", "", bytes.NewReader(scrapeResult(t, r)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	push.Body.Close()
+	if w := <-scraped; w.Code != http.StatusOK {
+		t.Fatalf("Expected scrape to succeed, got %d: %s", w.Code, w.Body)
+	}
+
+	resp, err := http.Get(ts.URL + "/api/v1/clients/client.example.com/scrapes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var records []scrapeRecord
+	if err := json.NewDecoder(resp.Body).Decode(&records); err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 {
+		t.Fatalf("Expected 1 scrape, got %+v", records)
+	}
+	want := scrapeRecord{
+		ScrapeID: r.Header.Get("Id"),
+		URL:      "http://client.example.com/metrics",
+		Status:   http.StatusOK,
+		Bytes:    int64(len("/metrics")),
+	}
+	if got := records[0]; got.ScrapeID != want.ScrapeID || got.URL != want.URL || got.Status != want.Status || got.Bytes != want.Bytes {
+		t.Errorf("Expected %+v, got %+v", want, got)
+	}
+
+	resp, err = http.Get(ts.URL + "/api/v1/clients/unknown.example.com/scrapes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected unknown client to be not found, got %s", resp.Status)
+	}
+}
+
+func TestDeregisterIdentity(t *testing.T) {
+	ts, c := newProtocolTestProxy(t)
+	defer ts.Close()
+	h := ts.Config.Handler.(*httpHandler)
+	deregister := func(method, remoteAddr string, header http.Header) int {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, "/deregister", strings.NewReader("client.example.com"))
+		r.RemoteAddr = remoteAddr
+		for k, v := range header {
+			r.Header[k] = v
+		}
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	// The client polls from 192.0.2.1.
+	ctx, cancel := context.WithCancel(context.Background())
+	polled := make(chan struct{})
+	go func() {
+		defer close(polled)
+		r := httptest.NewRequest(http.MethodPost, "/poll", strings.NewReader("client.example.com")).WithContext(ctx)
+		r.RemoteAddr = "192.0.2.1:1234"
+		h.ServeHTTP(httptest.NewRecorder(), r)
+	}()
+	for deadline := time.Now().Add(5 * time.Second); !c.IsKnown("client.example.com"); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the client to be known")
+		}
+	}
+	cancel()
+	<-polled
+
+	if code := deregister(http.MethodGet, "192.0.2.1:1234", nil); code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected GET to be refused, got %d", code)
+	}
+	if code := deregister(http.MethodPost, "198.51.100.1:1234", nil); code != http.StatusForbidden {
+		t.Errorf("Expected another host to be refused, got %d", code)
+	}
+	// Credentials and headers the proxy doesn't check must not pass for the
+	// client.
+	*auditIdentityHeader = "X-Remote-User"
+	defer func() { *auditIdentityHeader = "" }()
+	spoofed := http.Header{
+		"Authorization": {"Basic " + base64.StdEncoding.EncodeToString([]byte("192.0.2.1:secret"))},
+		"X-Remote-User": {"192.0.2.1"},
+	}
+	if code := deregister(http.MethodPost, "198.51.100.1:1234", spoofed); code != http.StatusForbidden {
+		t.Errorf("Expected another host claiming to be the client to be refused, got %d", code)
+	}
+	if !c.IsKnown("client.example.com") {
+		t.Fatal("Expected the client to still be known")
+	}
+	if code := deregister(http.MethodPost, "192.0.2.1:5678", nil); code != http.StatusOK {
+		t.Errorf("Expected the client to deregister itself, got %d", code)
+	}
+	if c.IsKnown("client.example.com") {
+		t.Error("Expected the client to be forgotten")
+	}
+}
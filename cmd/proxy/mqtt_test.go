@@ -0,0 +1,167 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	mqttserver "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/promslog"
+
+	"github.com/prometheus-community/pushprox/util"
+)
+
+// startBroker starts an embedded MQTT broker, returning its URL.
+func startBroker(t *testing.T) string {
+	s := mqttserver.New(&mqttserver.Options{Logger: slog.New(slog.DiscardHandler)})
+	if err := s.AddHook(new(auth.AllowHook), nil); err != nil {
+		t.Fatal(err)
+	}
+	tcp := listeners.NewTCP(listeners.Config{ID: "tcp", Address: "127.0.0.1:0"})
+	if err := s.AddListener(tcp); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Serve(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return "tcp://" + tcp.Address()
+}
+
+func TestMQTT(t *testing.T) {
+	ts, c := newProtocolTestProxy(t)
+	defer ts.Close()
+	h := ts.Config.Handler.(*httpHandler)
+	broker := startBroker(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// The client comes online and answers every scrape with its path.
+	client := mqtt.NewClient(mqtt.NewClientOptions().AddBroker(broker).SetClientID("client"))
+	if tok := client.Connect(); tok.Wait() && tok.Error() != nil {
+		t.Fatal(tok.Error())
+	}
+	defer client.Disconnect(0)
+	client.Subscribe(util.MQTTTopic("pushprox", "client.example.com", util.MQTTRequestTopic), util.MQTTQoS, func(_ mqtt.Client, msg mqtt.Message) {
+		r, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(msg.Payload())))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		client.Publish(util.MQTTTopic("pushprox", "client.example.com", util.MQTTResultTopic), util.MQTTQoS, false, scrapeResult(t, r))
+	}).Wait()
+	client.Publish(util.MQTTTopic("pushprox", "client.example.com", util.MQTTStatusTopic), util.MQTTQoS, true, util.MQTTOnline).Wait()
+
+	bridge := newMQTTBridge(h, promslog.NewNopLogger(), broker, "proxy", "pushprox")
+	defer bridge.Close()
+	for !c.IsKnown("client.example.com") {
+		if ctx.Err() != nil {
+			t.Fatal("Expected the client online to be known")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	results := queueScrapes(ctx, c, 2)
+	got := map[string]bool{<-results: true, <-results: true}
+	if !got["/0"] || !got["/1"] {
+		t.Errorf("Expected the results of both scrapes, got %v", got)
+	}
+
+	client.Publish(util.MQTTTopic("pushprox", "client.example.com", util.MQTTStatusTopic), util.MQTTQoS, true, util.MQTTOffline).Wait()
+	for {
+		bridge.mu.Lock()
+		n := len(bridge.clients)
+		bridge.mu.Unlock()
+		if n == 0 {
+			break
+		}
+		if ctx.Err() != nil {
+			t.Fatal("Expected the client to go offline")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// Going offline on purpose deregisters the client.
+	for c.IsKnown("client.example.com") {
+		if ctx.Err() != nil {
+			t.Fatal("Expected the client to be deregistered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if stale := c.StaleClients(); len(stale) != 0 {
+		t.Errorf("Expected the deregistered client not to be stale, got %v", stale)
+	}
+	if v := testutil.ToFloat64(clientUp.WithLabelValues("client.example.com")); v != 0 {
+		t.Errorf("Expected the deregistered client to be down, got %v", v)
+	}
+}
+
+func TestMQTTSharding(t *testing.T) {
+	*clusterSharding = true
+	*clusterAdvertiseURL = "http://self.example.com:8080/"
+	defer func() { *clusterSharding = false; *clusterAdvertiseURL = "" }()
+	cl, err := newCluster([]string{"http://peer.example.com:8080/"}, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts, c := newProtocolTestProxy(t)
+	defer ts.Close()
+	h := ts.Config.Handler.(*httpHandler)
+	h.cluster = cl
+	broker := startBroker(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// One client assigned to this replica, and one to the peer.
+	var own, other string
+	for i := 0; own == "" || other == ""; i++ {
+		k := fmt.Sprintf("client-%d.example.com", i)
+		if cl.ring.get(k) == "http://peer.example.com:8080/" {
+			other = k
+		} else {
+			own = k
+		}
+	}
+	client := mqtt.NewClient(mqtt.NewClientOptions().AddBroker(broker).SetClientID("client"))
+	if tok := client.Connect(); tok.Wait() && tok.Error() != nil {
+		t.Fatal(tok.Error())
+	}
+	defer client.Disconnect(0)
+	client.Publish(util.MQTTTopic("pushprox", other, util.MQTTStatusTopic), util.MQTTQoS, true, util.MQTTOnline).Wait()
+	client.Publish(util.MQTTTopic("pushprox", own, util.MQTTStatusTopic), util.MQTTQoS, true, util.MQTTOnline).Wait()
+
+	bridge := newMQTTBridge(h, promslog.NewNopLogger(), broker, "proxy", "pushprox")
+	defer bridge.Close()
+	for !c.IsKnown(own) {
+		if ctx.Err() != nil {
+			t.Fatal("Expected the client assigned to this replica to be known")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	bridge.mu.Lock()
+	_, served := bridge.clients[other]
+	bridge.mu.Unlock()
+	if served || c.IsKnown(other) {
+		t.Errorf("Expected %s, assigned to the peer, not to be served", other)
+	}
+}
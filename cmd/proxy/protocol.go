@@ -0,0 +1,83 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/prometheus-community/pushprox/util"
+)
+
+var maxBatchSize = kingpin.Flag("poll.max-batch-size", "Maximum number of scrapes returned in a single poll response to clients supporting batches.").Default("100").Int()
+
+var (
+	pollsByVersion = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "polls_total",
+			Help:      "Number of polls by protocol version spoken by the client.",
+		}, []string{"version"},
+	)
+	batchSizeHistogram = promauto.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "poll_batch_size",
+			Help:      "Number of scrapes returned in batched poll responses.",
+			Buckets:   []float64{1, 2, 5, 10, 20, 50, 100},
+		},
+	)
+)
+
+// supportedCapabilities returns the capabilities the proxy accepts.
+func supportedCapabilities() util.Capabilities {
+	c := util.Capabilities{util.CapabilityScrapeLimit: 0, util.CapabilityGzip: 0, util.CapabilityZstd: 0}
+	if *maxBatchSize > 1 {
+		c[util.CapabilityBatch] = *maxBatchSize
+	}
+	return c
+}
+
+// negotiate picks the protocol version and capabilities used for a poll.
+func negotiate(p util.Poll) util.PollResponse {
+	pollsByVersion.WithLabelValues(strconv.Itoa(p.Version)).Inc()
+	version, accepted := util.Negotiate(p, supportedCapabilities())
+	return util.PollResponse{Version: version, Capabilities: accepted}
+}
+
+// nextRequests adds the scrapes already waiting for the client to request,
+// up to the negotiated batch size.
+func (h *httpHandler) nextRequests(ctx context.Context, fqdn string, request *http.Request, caps util.Capabilities) []*http.Request {
+	requests := []*http.Request{request}
+	if !caps.Has(util.CapabilityBatch) {
+		return requests
+	}
+	for len(requests) < caps[util.CapabilityBatch] {
+		next, err := h.coordinator.NextScrapeInstruction(ctx, fqdn)
+		if err != nil {
+			h.logger.Warn("Error getting further scrapes", "fqdn", fqdn, "err", err)
+			break
+		}
+		if next == nil {
+			break
+		}
+		requests = append(requests, next)
+	}
+	batchSizeHistogram.Observe(float64(len(requests)))
+	return requests
+}
@@ -0,0 +1,214 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/promslog"
+
+	"github.com/prometheus-community/pushprox/util"
+)
+
+// queueScrapes starts n scrapes of client.example.com, returning the bodies
+// of their results.
+func queueScrapes(ctx context.Context, c Coordinator, n int) <-chan string {
+	results := make(chan string, n)
+	for i := range n {
+		go func() {
+			r, _ := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("http://client.example.com/%d", i), nil)
+			resp, err := c.DoScrape(ctx, r)
+			if err != nil {
+				results <- ""
+				return
+			}
+			body, _ := io.ReadAll(resp.Body)
+			results <- string(body)
+		}()
+	}
+	return results
+}
+
+// waitForQueued waits until n scrapes wait for their client to poll.
+func waitForQueued(t *testing.T, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		queued := int(testutil.ToFloat64(scrapesQueued))
+		if queued == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d queued scrapes, got %d", n, queued)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// pollScrape polls for a scrape of client.example.com, waiting for one to
+// be queued.
+func pollScrape(t *testing.T, url string) *http.Request {
+	resp, err := http.Post(url+"/poll", "", strings.NewReader("client.example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	r, err := http.ReadRequest(bufio.NewReader(resp.Body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// scrapeResult serializes a result echoing the path of the scrape request.
+func scrapeResult(t *testing.T, r *http.Request) []byte {
+	body := r.URL.Path
+	result := &http.Response{
+		StatusCode:    http.StatusOK,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Id": {r.Header.Get("Id")}},
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+	}
+	msg := &bytes.Buffer{}
+	if err := result.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	return msg.Bytes()
+}
+
+func newProtocolTestProxy(t *testing.T) (*httptest.Server, *memoryCoordinator) {
+	*registrationTimeout = 5 * time.Minute
+	*maxScrapeTimeout = time.Minute
+	*defaultScrapeTimeout = 10 * time.Second
+	*maxBatchSize = 100
+	*streamMaxFrameSize = 16 << 20
+	c, err := NewMemoryCoordinator(promslog.NewNopLogger(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newHTTPHandler(promslog.NewNopLogger(), c, nil, nil, http.NewServeMux())
+	return httptest.NewServer(h), c
+}
+
+func TestBatchedPoll(t *testing.T) {
+	ts, c := newProtocolTestProxy(t)
+	defer ts.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	const scrapes = 3
+	results := queueScrapes(ctx, c, scrapes)
+	waitForQueued(t, scrapes)
+
+	poll, err := util.NewPollRequest(ctx, ts.URL+"/poll", util.Poll{
+		FQDN:         "client.example.com",
+		Version:      util.ProtocolVersion,
+		Capabilities: util.Capabilities{util.CapabilityBatch: 10, "unknown": 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(poll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	pr, err := util.ReadPollResponse(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pr.Version != util.ProtocolVersion {
+		t.Errorf("Expected protocol version %d, got %d", util.ProtocolVersion, pr.Version)
+	}
+	if got := pr.Capabilities.String(); got != "batch=10" {
+		t.Errorf("Expected only batches of 10 to be accepted, got %q", got)
+	}
+	if len(pr.Requests) != scrapes {
+		t.Fatalf("Expected %d scrapes in one poll, got %d", scrapes, len(pr.Requests))
+	}
+
+	var msgs [][]byte
+	for _, r := range pr.Requests {
+		msgs = append(msgs, scrapeResult(t, r))
+	}
+	push, err := util.NewPushRequest(ctx, ts.URL+"/push", pr.Version, msgs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pushResp, err := http.DefaultClient.Do(push)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pushResp.Body.Close()
+	if pushResp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected batched push to succeed, got %s", pushResp.Status)
+	}
+
+	got := map[string]bool{}
+	for range scrapes {
+		got[<-results] = true
+	}
+	for i := range scrapes {
+		if !got[fmt.Sprintf("/%d", i)] {
+			t.Errorf("Expected result of scrape %d, got %v", i, got)
+		}
+	}
+}
+
+func TestVersion1Poll(t *testing.T) {
+	ts, c := newProtocolTestProxy(t)
+	defer ts.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	results := queueScrapes(ctx, c, 2)
+
+	// As sent by clients predating protocol versions.
+	resp, err := http.Post(ts.URL+"/poll", "", strings.NewReader("client.example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if v := resp.Header.Get(util.ProtocolVersionHeader); v != "" {
+		t.Errorf("Expected no protocol version for version 1 clients, got %q", v)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(body)))
+	if err != nil {
+		t.Fatalf("Expected a single scrape request, got %q: %v", body, err)
+	}
+
+	push, err := http.Post(ts.URL+"/push", "", bytes.NewReader(scrapeResult(t, r)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	push.Body.Close()
+	if push.StatusCode != http.StatusOK {
+		t.Fatalf("Expected push to succeed, got %s", push.Status)
+	}
+	if got := <-results; got != r.URL.Path {
+		t.Errorf("Expected result %q, got %q", r.URL.Path, got)
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var resultsAbandoned = promauto.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "scrape_results_abandoned_total",
+		Help:      "Number of streamed scrape results not read to the end, e.g. because Prometheus disconnected.",
+	},
+)
+
+// errResultAbandoned is returned to clients whose result was not read to the
+// end, so that they stop sending it.
+var errResultAbandoned = errors.New("scrape result abandoned before it was read")
+
+// pushedBody is the body of a result streamed from a push. It tells the push
+// once the scrape is done with it, as the push has to stay open until then.
+type pushedBody struct {
+	io.ReadCloser
+	eof  atomic.Bool
+	once sync.Once
+	done chan struct{}
+}
+
+func newPushedBody(body io.ReadCloser) *pushedBody {
+	return &pushedBody{ReadCloser: body, done: make(chan struct{})}
+}
+
+func (b *pushedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if errors.Is(err, io.EOF) {
+		b.eof.Store(true)
+		b.finish()
+	}
+	return n, err
+}
+
+func (b *pushedBody) Close() error {
+	b.finish()
+	return nil
+}
+
+func (b *pushedBody) finish() {
+	b.once.Do(func() { close(b.done) })
+}
+
+// wait waits until the scrape read the body to the end or closed it,
+// returning an error in the latter case.
+func (b *pushedBody) wait(ctx context.Context) error {
+	select {
+	case <-b.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if !b.eof.Load() {
+		resultsAbandoned.Inc()
+		return errResultAbandoned
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// startStreamedPush polls for a scrape and starts pushing its result,
+// returning the writer for the result body and the status of the push.
+func startStreamedPush(t *testing.T, url string) (*io.PipeWriter, <-chan int) {
+	r := pollScrape(t, url)
+	pr, pw := io.Pipe()
+	status := make(chan int, 1)
+	go func() {
+		resp, err := http.Post(url+"/push", "", pr)
+		if err != nil {
+			status <- 0
+			return
+		}
+		resp.Body.Close()
+		status <- resp.StatusCode
+	}()
+	fmt.Fprintf(pw, "HTTP/1.1 200 OK\r\nId: %s\r\nConnection: close\r\n\r\n", r.Header.Get("Id"))
+	return pw, status
+}
+
+func TestStreamedPush(t *testing.T) {
+	ts, c := newProtocolTestProxy(t)
+	defer ts.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	scraped := make(chan *http.Response, 1)
+	go func() {
+		r, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://client.example.com/metrics", nil)
+		resp, err := c.DoScrape(ctx, r)
+		if err != nil {
+			t.Error(err)
+			close(scraped)
+			return
+		}
+		scraped <- resp
+	}()
+
+	pw, status := startStreamedPush(t, ts.URL)
+	io.WriteString(pw, "up 1\n")
+	resp := <-scraped
+	if resp == nil {
+		t.FailNow()
+	}
+	defer resp.Body.Close()
+	// The start of the result arrives while it is still being pushed.
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(resp.Body, buf); err != nil || string(buf) != "up 1\n" {
+		t.Fatalf("Expected the start of the result, got %q: %v", buf, err)
+	}
+	select {
+	case code := <-status:
+		t.Fatalf("Expected the push to wait for the result to be read, got %d", code)
+	default:
+	}
+	io.WriteString(pw, "up 2\n")
+	pw.Close()
+	rest, err := io.ReadAll(resp.Body)
+	if err != nil || string(rest) != "up 2\n" {
+		t.Fatalf("Expected the rest of the result, got %q: %v", rest, err)
+	}
+	if code := <-status; code != http.StatusOK {
+		t.Errorf("Expected push to succeed, got %d", code)
+	}
+}
+
+func TestAbandonedPush(t *testing.T) {
+	ts, c := newProtocolTestProxy(t)
+	defer ts.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	go func() {
+		r, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://client.example.com/metrics", nil)
+		resp, err := c.DoScrape(ctx, r)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		// Prometheus goes away in the middle of the result.
+		io.ReadFull(resp.Body, make([]byte, 5))
+		resp.Body.Close()
+	}()
+
+	pw, status := startStreamedPush(t, ts.URL)
+	defer pw.Close()
+	io.WriteString(pw, "up 1\n")
+	if code := <-status; code != http.StatusInternalServerError {
+		t.Errorf("Expected push of an abandoned result to fail, got %d", code)
+	}
+}
+
+func TestTruncatedPush(t *testing.T) {
+	ts, _ := newProtocolTestProxy(t)
+	defer ts.Close()
+	proxyURL, _ := url.Parse(ts.URL)
+	prometheus := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	scraped := make(chan error, 1)
+	go func() {
+		resp, err := prometheus.Get("http://client.example.com/metrics")
+		if err == nil {
+			_, err = io.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+		scraped <- err
+	}()
+
+	pw, _ := startStreamedPush(t, ts.URL)
+	io.WriteString(pw, "up 1\n")
+	// The client goes away in the middle of the result.
+	pw.CloseWithError(errors.New("client went away"))
+	if err := <-scraped; err == nil {
+		t.Error("Expected the scrape of a truncated result to fail")
+	}
+}
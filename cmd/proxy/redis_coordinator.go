@@ -0,0 +1,542 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/prometheus-community/pushprox/util"
+)
+
+var (
+	redisURL       = kingpin.Flag("redis.url", "URL of the Redis server used by the redis coordinator, e.g. redis://localhost:6379/0.").Default("redis://localhost:6379/0").String()
+	redisKeyPrefix = kingpin.Flag("redis.key-prefix", "Prefix of all keys used by the redis coordinator.").Default("pushprox:").String()
+)
+
+// redisPollInterval is how often waiting polls and scrapes look for a queued
+// scrape or result without being notified, as notifications can be lost, e.g.
+// while reconnecting to Redis.
+const redisPollInterval = 5 * time.Second
+
+// queuedScrape is a scrape waiting in Redis for its client to poll.
+type queuedScrape struct {
+	Deadline time.Time `json:"deadline"`
+	Request  []byte    `json:"request"`
+}
+
+// redisCoordinator is a Coordinator keeping all state in Redis, so that
+// polls, pushes and scrapes can be handled by different replicas.
+type redisCoordinator struct {
+	client *redis.Client
+	prefix string
+	// Polls and scrapes of this replica waiting for a list in Redis.
+	waiters *redisWaiters
+
+	// When clients were last garbage collected.
+	lastGC time.Time
+
+	mu sync.Mutex
+	// The clients this replica exports pushprox_proxy_client_up for, and when
+	// it last set them.
+	exported map[string]time.Time
+
+	audit  *util.AuditLog
+	logger *slog.Logger
+}
+
+// NewRedisCoordinator connects to Redis and starts the client cleanup routine.
+func NewRedisCoordinator(logger *slog.Logger, audit *util.AuditLog) (*redisCoordinator, error) {
+	opts, err := redis.ParseURL(*redisURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redis URL: %w", err)
+	}
+	c := newRedisCoordinator(redis.NewClient(opts), logger, audit)
+	if err := c.client.Ping(context.Background()).Err(); err != nil {
+		return nil, fmt.Errorf("connecting to redis: %w", err)
+	}
+	go c.gc()
+	return c, nil
+}
+
+func newRedisCoordinator(client *redis.Client, logger *slog.Logger, audit *util.AuditLog) *redisCoordinator {
+	c := &redisCoordinator{
+		client:   client,
+		prefix:   *redisKeyPrefix,
+		waiters:  newRedisWaiters(),
+		exported: map[string]time.Time{},
+		audit:    audit,
+		logger:   logger,
+	}
+	// A single connection per replica receives all notifications, rather than
+	// every waiting poll and scrape blocking a connection of the pool.
+	go c.listen(client.Subscribe(context.Background(), c.notifyChannel()))
+	return c
+}
+
+// listen wakes up the waiters of the lists pushed to, until the client is
+// closed.
+func (c *redisCoordinator) listen(sub *redis.PubSub) {
+	for msg := range sub.Channel() {
+		c.waiters.wake(msg.Payload)
+	}
+}
+
+// notifyChannel is where the keys of lists are published once pushed to.
+func (c *redisCoordinator) notifyChannel() string {
+	return c.prefix + "notify"
+}
+
+func (c *redisCoordinator) clientsKey() string {
+	return c.prefix + "clients"
+}
+
+// leftKey holds the clients which deregistered, scored by when they did, so
+// that all replicas mark them as down.
+func (c *redisCoordinator) leftKey() string {
+	return c.prefix + "left"
+}
+
+func (c *redisCoordinator) requestsKey(fqdn string) string {
+	return c.prefix + "requests:" + fqdn
+}
+
+func (c *redisCoordinator) responseKey(id string) string {
+	return c.prefix + "responses:" + id
+}
+
+func (c *redisCoordinator) historyKey(fqdn string) string {
+	return c.prefix + "history:" + fqdn
+}
+
+// DoScrape queues a scrape for the client and waits for its result.
+func (c *redisCoordinator) DoScrape(ctx context.Context, r *http.Request) (*http.Response, error) {
+	id, err := genID()
+	if err != nil {
+		return nil, err
+	}
+	c.logger.Info("DoScrape", "scrape_id", id, "url", r.URL.String())
+	r.Header.Add("Id", id)
+	// Continue the trace on the client.
+	util.InjectTraceContext(ctx, r.Header)
+
+	buf := &bytes.Buffer{}
+	if err := r.WriteProxy(buf); err != nil {
+		return nil, err
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(*maxScrapeTimeout)
+	}
+	queued, err := json.Marshal(queuedScrape{Deadline: deadline, Request: buf.Bytes()})
+	if err != nil {
+		return nil, err
+	}
+	key := c.requestsKey(r.URL.Hostname())
+	pipe := c.client.TxPipeline()
+	pipe.RPush(ctx, key, queued)
+	// Scrapes nobody polled for must not pile up.
+	pipe.Expire(ctx, key, *maxScrapeTimeout)
+	pipe.Publish(ctx, c.notifyChannel(), key)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, fmt.Errorf("queueing scrape: %w", err)
+	}
+
+	_, span := tracer.Start(ctx, "wait for result", trace.WithAttributes(attribute.String("scrape_id", id)))
+	defer span.End()
+	ctx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+	res, err := c.pop(ctx, c.responseKey(id))
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		return nil, fmt.Errorf("timeout reached for %q: %w", r.URL.String(), err)
+	}
+	return http.ReadResponse(bufio.NewReader(bytes.NewReader([]byte(res))), nil)
+}
+
+// pop removes and returns the first element of the list key, waiting until
+// there is one or ctx is done.
+func (c *redisCoordinator) pop(ctx context.Context, key string) (string, error) {
+	// Wait before looking, so that no notification is missed in between.
+	woken := c.waiters.add(key)
+	defer c.waiters.remove(key, woken)
+	for {
+		res, err := c.client.LPop(ctx, key).Result()
+		if !errors.Is(err, redis.Nil) {
+			return res, err
+		}
+		select {
+		case <-woken:
+		case <-time.After(redisPollInterval):
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+}
+
+// WaitForScrapeInstruction registers a client and waits for a queued scrape.
+func (c *redisCoordinator) WaitForScrapeInstruction(ctx context.Context, fqdn string) (*http.Request, error) {
+	c.logger.Info("WaitForScrapeInstruction", "fqdn", fqdn)
+	if err := c.addKnownClient(ctx, fqdn); err != nil {
+		return nil, err
+	}
+
+	for {
+		res, err := c.pop(ctx, c.requestsKey(fqdn))
+		if err != nil {
+			return nil, err
+		}
+		request, err := decodeQueuedScrape(res)
+		if err != nil || request != nil {
+			return request, err
+		}
+		// Scrape has timed out, get another one.
+	}
+}
+
+// NextScrapeInstruction returns a scrape already queued for fqdn, if any.
+func (c *redisCoordinator) NextScrapeInstruction(ctx context.Context, fqdn string) (*http.Request, error) {
+	for {
+		res, err := c.client.LPop(ctx, c.requestsKey(fqdn)).Result()
+		if errors.Is(err, redis.Nil) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		request, err := decodeQueuedScrape(res)
+		if err != nil || request != nil {
+			return request, err
+		}
+	}
+}
+
+// decodeQueuedScrape decodes a scrape queued by DoScrape. It returns nil if
+// the scrape has timed out.
+func decodeQueuedScrape(s string) (*http.Request, error) {
+	var queued queuedScrape
+	if err := json.Unmarshal([]byte(s), &queued); err != nil {
+		return nil, fmt.Errorf("decoding queued scrape: %w", err)
+	}
+	if time.Now().After(queued.Deadline) {
+		return nil, nil
+	}
+	request, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(queued.Request)))
+	if err != nil {
+		return nil, fmt.Errorf("decoding queued scrape: %w", err)
+	}
+	return request.WithContext(util.ExtractTraceContext(context.Background(), request.Header)), nil
+}
+
+// ScrapeResult hands the result to the replica waiting for it.
+func (c *redisCoordinator) ScrapeResult(r *http.Response) error {
+	id := r.Header.Get("Id")
+	c.logger.Info("ScrapeResult", "scrape_id", id)
+	timeout := util.GetScrapeTimeout(maxScrapeTimeout, defaultScrapeTimeout, r.Header)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	// Don't expose internal headers.
+	r.Header.Del("Id")
+	r.Header.Del("X-Prometheus-Scrape-Timeout-Seconds")
+	buf := &bytes.Buffer{}
+	if err := r.Write(buf); err != nil {
+		return err
+	}
+	key := c.responseKey(id)
+	pipe := c.client.TxPipeline()
+	pipe.RPush(ctx, key, buf.Bytes())
+	pipe.Expire(ctx, key, timeout)
+	pipe.Publish(ctx, c.notifyChannel(), key)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// Deregister forgets a client right away, rather than having it expire, and
+// marks it as left.
+func (c *redisCoordinator) Deregister(fqdn string) error {
+	ctx := context.Background()
+	pipe := c.client.TxPipeline()
+	now := time.Now()
+	pipe.ZRem(ctx, c.clientsKey(), fqdn)
+	pipe.Del(ctx, c.historyKey(fqdn))
+	pipe.ZAdd(ctx, c.leftKey(), redis.Z{Score: float64(now.UnixMilli()), Member: fqdn})
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("deregistering client: %w", err)
+	}
+	c.setClientUp(fqdn, 0, now)
+	c.audit.Log(auditEntry{Timestamp: now, Event: auditDeregister, FQDN: fqdn})
+	return nil
+}
+
+// setClientUp sets pushprox_proxy_client_up of a client on this replica.
+func (c *redisCoordinator) setClientUp(fqdn string, v float64, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.exported[fqdn] = now
+	clientUp.WithLabelValues(fqdn).Set(v)
+}
+
+func (c *redisCoordinator) addKnownClient(ctx context.Context, fqdn string) error {
+	now := time.Now()
+	pipe := c.client.TxPipeline()
+	prev := pipe.ZScore(ctx, c.clientsKey(), fqdn)
+	pipe.ZAdd(ctx, c.clientsKey(), redis.Z{Score: float64(now.UnixMilli()), Member: fqdn})
+	pipe.ZRem(ctx, c.leftKey(), fqdn)
+	if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+		return fmt.Errorf("registering client: %w", err)
+	}
+	if ts, err := prev.Result(); err != nil || time.UnixMilli(int64(ts)).Before(now.Add(-*registrationTimeout)) {
+		// New client, or one coming back after its registration expired.
+		knownClients.Inc()
+		c.audit.Log(auditEntry{Timestamp: now, Event: auditRegister, FQDN: fqdn})
+	}
+	c.setClientUp(fqdn, 1, now)
+	return nil
+}
+
+// clientsBetween returns the clients which last polled in (from, to].
+func (c *redisCoordinator) clientsBetween(from, to string) []redis.Z {
+	clients, err := c.client.ZRangeByScoreWithScores(context.Background(), c.clientsKey(), &redis.ZRangeBy{Min: from, Max: to}).Result()
+	if err != nil {
+		c.logger.Error("Error listing clients", "err", err)
+		return nil
+	}
+	return clients
+}
+
+func scoreAfter(t time.Time) string {
+	return "(" + strconv.FormatInt(t.UnixMilli(), 10)
+}
+
+func scoreUntil(t time.Time) string {
+	return strconv.FormatInt(t.UnixMilli(), 10)
+}
+
+// KnownClients returns a list of alive clients
+func (c *redisCoordinator) KnownClients() []string {
+	clients := c.clientsBetween(scoreAfter(time.Now().Add(-*registrationTimeout)), "+inf")
+	known := make([]string, 0, len(clients))
+	for _, z := range clients {
+		known = append(known, z.Member.(string))
+	}
+	return known
+}
+
+// StaleClients returns a list of clients whose registration expired, but
+// which are still within the registration retention.
+func (c *redisCoordinator) StaleClients() []string {
+	now := time.Now()
+	clients := c.clientsBetween("-inf", scoreUntil(now.Add(-*registrationTimeout)))
+	stale := make([]string, 0, len(clients))
+	for _, z := range clients {
+		stale = append(stale, z.Member.(string))
+	}
+	return stale
+}
+
+// IsKnown returns whether a client polled within the registration timeout.
+func (c *redisCoordinator) IsKnown(fqdn string) bool {
+	ts, err := c.client.ZScore(context.Background(), c.clientsKey(), fqdn).Result()
+	return err == nil && time.Now().Add(-*registrationTimeout).Before(time.UnixMilli(int64(ts)))
+}
+
+// Registrations returns the alive clients and when they last polled.
+func (c *redisCoordinator) Registrations() []registration {
+	clients := c.clientsBetween(scoreAfter(time.Now().Add(-*registrationTimeout)), "+inf")
+	regs := make([]registration, 0, len(clients))
+	for _, z := range clients {
+		regs = append(regs, registration{FQDN: z.Member.(string), LastSeen: time.UnixMilli(int64(z.Score))})
+	}
+	return regs
+}
+
+// RecordScrape remembers a scrape of a known client.
+func (c *redisCoordinator) RecordScrape(fqdn string, r scrapeRecord) {
+	if *scrapeHistorySize <= 0 {
+		return
+	}
+	ctx := context.Background()
+	if err := c.client.ZScore(ctx, c.clientsKey(), fqdn).Err(); err != nil {
+		return
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		return
+	}
+	key := c.historyKey(fqdn)
+	pipe := c.client.TxPipeline()
+	pipe.LPush(ctx, key, b)
+	pipe.LTrim(ctx, key, 0, int64(*scrapeHistorySize-1))
+	pipe.Expire(ctx, key, max(*registrationTimeout, *registrationRetention))
+	if _, err := pipe.Exec(ctx); err != nil {
+		c.logger.Warn("Error recording scrape", "err", err, "fqdn", fqdn)
+	}
+}
+
+// ScrapeHistory returns the recent scrapes of a client, oldest first.
+func (c *redisCoordinator) ScrapeHistory(fqdn string) ([]scrapeRecord, bool) {
+	ctx := context.Background()
+	if err := c.client.ZScore(ctx, c.clientsKey(), fqdn).Err(); err != nil {
+		return nil, false
+	}
+	entries, err := c.client.LRange(ctx, c.historyKey(fqdn), 0, -1).Result()
+	if err != nil {
+		c.logger.Warn("Error reading scrape history", "err", err, "fqdn", fqdn)
+	}
+	records := make([]scrapeRecord, 0, len(entries))
+	for _, e := range entries {
+		var r scrapeRecord
+		if err := json.Unmarshal([]byte(e), &r); err == nil {
+			records = append(records, r)
+		}
+	}
+	slices.Reverse(records)
+	return records, true
+}
+
+// Garbage collect old clients.
+func (c *redisCoordinator) gc() {
+	for range time.Tick(1 * time.Minute) {
+		c.expire(time.Now())
+	}
+}
+
+// expire updates the client metrics of this replica to match the clients in
+// Redis, and forgets clients which are past the registration retention.
+func (c *redisCoordinator) expire(now time.Time) {
+	ctx := context.Background()
+	limit := now.Add(-*registrationTimeout)
+	prevLimit := c.lastGC.Add(-*registrationTimeout)
+	retentionLimit := now.Add(-max(*registrationTimeout, *registrationRetention))
+	deleted, stale, alive := 0, 0, 0
+	// Clients to export, as other replicas may have seen them.
+	seen := map[string]bool{}
+	clients, err := c.client.ZRangeWithScores(ctx, c.clientsKey(), 0, -1).Result()
+	if err != nil {
+		// Keep the series as they are, rather than dropping them all
+		// while Redis can't be reached.
+		c.logger.Error("Error listing clients", "err", err)
+		return
+	}
+	for _, z := range clients {
+		k, ts := z.Member.(string), time.UnixMilli(int64(z.Score))
+		switch {
+		case ts.Before(retentionLimit):
+			// Every replica collects garbage, only one of them removes the client.
+			if n, err := c.client.ZRem(ctx, c.clientsKey(), k).Result(); err == nil && n > 0 {
+				c.client.Del(ctx, c.historyKey(k))
+				c.audit.Log(auditEntry{Timestamp: now, Event: auditForget, FQDN: k})
+				deleted++
+			}
+		case ts.Before(limit):
+			c.setClientUp(k, 0, now)
+			seen[k] = true
+			if !ts.Before(prevLimit) {
+				// Expired since the last run.
+				c.audit.Log(auditEntry{Timestamp: now, Event: auditExpire, FQDN: k})
+			}
+			stale++
+		default:
+			// The client may have polled another replica.
+			c.setClientUp(k, 1, now)
+			seen[k] = true
+			alive++
+		}
+	}
+	// Clients which deregistered from any replica.
+	c.client.ZRemRangeByScore(ctx, c.leftKey(), "-inf", scoreUntil(retentionLimit))
+	left, err := c.client.ZRange(ctx, c.leftKey(), 0, -1).Result()
+	if err != nil {
+		c.logger.Error("Error listing clients which left", "err", err)
+		return
+	}
+	for _, k := range left {
+		if !seen[k] {
+			c.setClientUp(k, 0, now)
+			seen[k] = true
+		}
+	}
+	// Drop the series of clients gone from Redis, unless set since.
+	c.mu.Lock()
+	for k, ts := range c.exported {
+		if !seen[k] && !ts.After(now) {
+			delete(c.exported, k)
+			clientUp.DeleteLabelValues(k)
+		}
+	}
+	c.mu.Unlock()
+	c.lastGC = now
+	c.logger.Info("GC of clients completed", "deleted", deleted, "stale", stale, "remaining", alive+stale)
+	knownClients.Set(float64(alive))
+}
+
+// redisWaiters wakes up the polls and scrapes of this replica waiting for a
+// list in Redis to be pushed to.
+type redisWaiters struct {
+	mu      sync.Mutex
+	waiting map[string]map[chan struct{}]struct{}
+}
+
+func newRedisWaiters() *redisWaiters {
+	return &redisWaiters{waiting: map[string]map[chan struct{}]struct{}{}}
+}
+
+// add returns a channel receiving once key was pushed to.
+func (w *redisWaiters) add(key string) chan struct{} {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	ch := make(chan struct{}, 1)
+	if w.waiting[key] == nil {
+		w.waiting[key] = map[chan struct{}]struct{}{}
+	}
+	w.waiting[key][ch] = struct{}{}
+	return ch
+}
+
+func (w *redisWaiters) remove(key string, ch chan struct{}) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.waiting[key], ch)
+	if len(w.waiting[key]) == 0 {
+		delete(w.waiting, key)
+	}
+}
+
+// wake wakes up everyone waiting for key. Only one of them may get the
+// element pushed, the others wait on.
+func (w *redisWaiters) wake(key string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for ch := range w.waiting[key] {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
@@ -0,0 +1,198 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/promslog"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestRedisCoordinator(t *testing.T) {
+	*registrationTimeout = 5 * time.Minute
+	*maxScrapeTimeout = time.Minute
+	*defaultScrapeTimeout = 10 * time.Second
+	*scrapeHistorySize = 5
+	*redisKeyPrefix = "pushprox:"
+	s := miniredis.RunT(t)
+
+	// Polls, scrapes and pushes are handled by different replicas.
+	newReplica := func() *redisCoordinator {
+		return newRedisCoordinator(redis.NewClient(&redis.Options{Addr: s.Addr()}), promslog.NewNopLogger(), nil)
+	}
+	poller, scraper, pusher := newReplica(), newReplica(), newReplica()
+
+	go func() {
+		req, err := poller.WaitForScrapeInstruction(context.Background(), "client.example.com")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if req.URL.String() != "http://client.example.com:9100/metrics" {
+			t.Errorf("Unexpected scrape %s", req.URL)
+		}
+		resp := &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Id": {req.Header.Get("Id")}},
+			Body:       io.NopCloser(strings.NewReader("metrics")),
+		}
+		if err := pusher.ScrapeResult(resp); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://client.example.com:9100/metrics", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := scraper.DoScrape(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "metrics" {
+		t.Errorf("Expected scrape result, got %q", body)
+	}
+	if resp.Header.Get("Id") != "" {
+		t.Error("Expected internal headers to be removed")
+	}
+
+	if !scraper.IsKnown("client.example.com") {
+		t.Error("Expected client to be known by all replicas")
+	}
+	if known := scraper.KnownClients(); len(known) != 1 || known[0] != "client.example.com" {
+		t.Errorf("Expected [client.example.com], got %v", known)
+	}
+	scraper.RecordScrape("client.example.com", scrapeRecord{Status: 200})
+	scraper.RecordScrape("client.example.com", scrapeRecord{Status: 500})
+	if history, ok := pusher.ScrapeHistory("client.example.com"); !ok || len(history) != 2 || history[1].Status != 500 {
+		t.Errorf("Expected shared scrape history, got %v", history)
+	}
+}
+
+func TestRedisCoordinatorTimeout(t *testing.T) {
+	*maxScrapeTimeout = time.Minute
+	s := miniredis.RunT(t)
+	c := newRedisCoordinator(redis.NewClient(&redis.Options{Addr: s.Addr()}), promslog.NewNopLogger(), nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://client.example.com:9100/metrics", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.DoScrape(ctx, req); err == nil {
+		t.Fatal("Expected scrape without client to time out")
+	}
+}
+
+func TestRedisCoordinatorWaitersShareConnection(t *testing.T) {
+	*registrationTimeout = 5 * time.Minute
+	*maxScrapeTimeout = time.Minute
+	*defaultScrapeTimeout = 10 * time.Second
+	*scrapeHistorySize = 5
+	*redisKeyPrefix = "pushprox:"
+	s := miniredis.RunT(t)
+	// Waiting polls must not hold the only connection of the pool.
+	c := newRedisCoordinator(redis.NewClient(&redis.Options{Addr: s.Addr(), PoolSize: 1}), promslog.NewNopLogger(), nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	for _, fqdn := range []string{"idle1.example.com", "idle2.example.com", "idle3.example.com"} {
+		go c.WaitForScrapeInstruction(ctx, fqdn)
+	}
+	go func() {
+		req, err := c.WaitForScrapeInstruction(ctx, "client.example.com")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		resp := &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Id": {req.Header.Get("Id")}},
+			Body:       io.NopCloser(strings.NewReader("metrics")),
+		}
+		if err := c.ScrapeResult(resp); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://client.example.com:9100/metrics", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := c.DoScrape(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "metrics" {
+		t.Errorf("Expected scrape result, got %q", body)
+	}
+}
+
+func TestRedisCoordinatorClientUp(t *testing.T) {
+	*registrationTimeout = 5 * time.Minute
+	*registrationRetention = time.Hour
+	*redisKeyPrefix = "pushprox:"
+	clientUp.Reset()
+	s := miniredis.RunT(t)
+	newReplica := func() *redisCoordinator {
+		return newRedisCoordinator(redis.NewClient(&redis.Options{Addr: s.Addr()}), promslog.NewNopLogger(), nil)
+	}
+	a, b := newReplica(), newReplica()
+	ctx := context.Background()
+
+	for _, fqdn := range []string{"left.example.com", "removed.example.com"} {
+		if err := a.addKnownClient(ctx, fqdn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b.expire(time.Now())
+	if n := len(b.exported); n != 2 {
+		t.Fatalf("Expected 2 clients exported by the other replica, got %d", n)
+	}
+
+	if err := a.Deregister("left.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	// Replicas run in separate processes, where the other one still has the
+	// client up.
+	clientUp.WithLabelValues("left.example.com").Set(1)
+	b.expire(time.Now())
+	if v := testutil.ToFloat64(clientUp.WithLabelValues("left.example.com")); v != 0 {
+		t.Errorf("Expected client which left another replica to be down, got %v", v)
+	}
+
+	// Removed from Redis without this replica noticing.
+	s.ZRem(a.clientsKey(), "removed.example.com")
+	b.expire(time.Now())
+	if _, ok := b.exported["removed.example.com"]; ok {
+		t.Error("Expected series of client gone from Redis to be deleted")
+	}
+
+	b.expire(time.Now().Add(*registrationRetention + time.Minute))
+	if n := testutil.CollectAndCount(clientUp); n != 0 {
+		t.Errorf("Expected no series past the retention, got %d", n)
+	}
+}
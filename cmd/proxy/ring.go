@@ -0,0 +1,62 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"hash/fnv"
+	"slices"
+	"strconv"
+)
+
+// ringReplicas is the number of points each member has on the ring, which
+// evens out the share of clients per member.
+const ringReplicas = 128
+
+// hashRing assigns keys to members by consistent hashing, so that adding or
+// removing a member only moves the keys of that member.
+type hashRing struct {
+	points  []uint64
+	members map[uint64]string
+}
+
+func newHashRing(members []string) *hashRing {
+	r := &hashRing{members: map[uint64]string{}}
+	for _, m := range members {
+		for i := range ringReplicas {
+			h := hashKey(m + "#" + strconv.Itoa(i))
+			r.points = append(r.points, h)
+			r.members[h] = m
+		}
+	}
+	slices.Sort(r.points)
+	return r
+}
+
+func hashKey(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	return h.Sum64()
+}
+
+// get returns the member owning key.
+func (r *hashRing) get(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	h := hashKey(key)
+	i, _ := slices.BinarySearch(r.points, h)
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.members[r.points[i]]
+}
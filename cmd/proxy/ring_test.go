@@ -0,0 +1,43 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestHashRing(t *testing.T) {
+	members := []string{"http://a:8080/", "http://b:8080/", "http://c:8080/"}
+	r := newHashRing(members)
+	owners := map[string]string{}
+	counts := map[string]int{}
+	for i := range 3000 {
+		key := fmt.Sprintf("client-%d.example.com", i)
+		owners[key] = r.get(key)
+		counts[owners[key]]++
+	}
+	for _, m := range members {
+		if counts[m] < 500 {
+			t.Errorf("Expected an even share of clients, %s got %d of 3000", m, counts[m])
+		}
+	}
+
+	// Removing a member only moves its own clients.
+	r = newHashRing(members[:2])
+	for key, owner := range owners {
+		if owner != members[2] && r.get(key) != owner {
+			t.Errorf("Expected %s to stay on %s, moved to %s", key, owner, r.get(key))
+		}
+	}
+}
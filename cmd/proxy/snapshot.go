@@ -0,0 +1,130 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+)
+
+var (
+	snapshotFile     = kingpin.Flag("registration.snapshot-file", "File to persist known clients to, so they survive restarts. Disabled if empty.").String()
+	snapshotInterval = kingpin.Flag("registration.snapshot-interval", "How often to persist known clients.").Default("1m").Duration()
+)
+
+// snapshotVersion is the version of the snapshot file format.
+const snapshotVersion = 1
+
+type snapshot struct {
+	Version int            `json:"version"`
+	Clients []registration `json:"clients"`
+}
+
+// SaveSnapshot writes all clients within the registration retention to path.
+func (c *memoryCoordinator) SaveSnapshot(path string) error {
+	c.mu.Lock()
+	snap := snapshot{Version: snapshotVersion, Clients: make([]registration, 0, len(c.known))}
+	for k, t := range c.known {
+		snap.Clients = append(snap.Clients, registration{FQDN: k, LastSeen: t})
+	}
+	c.mu.Unlock()
+
+	b, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first, so a crash never leaves a partial snapshot.
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// LoadSnapshot restores the clients saved in path, keeping the time they last
+// polled so they expire as if the proxy never restarted.
+func (c *memoryCoordinator) LoadSnapshot(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var snap snapshot
+	if err := json.Unmarshal(b, &snap); err != nil {
+		return fmt.Errorf("decoding snapshot: %w", err)
+	}
+	if snap.Version != snapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %d", snap.Version)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	limit := now.Add(-*registrationTimeout)
+	retentionLimit := now.Add(-max(*registrationTimeout, *registrationRetention))
+	for _, r := range snap.Clients {
+		if r.LastSeen.Before(retentionLimit) {
+			continue
+		}
+		if t, ok := c.known[r.FQDN]; ok && t.After(r.LastSeen) {
+			// Polled since the restart.
+			continue
+		}
+		c.known[r.FQDN] = r.LastSeen
+	}
+	alive := 0
+	for k, t := range c.known {
+		if t.Before(limit) {
+			clientUp.WithLabelValues(k).Set(0)
+		} else {
+			clientUp.WithLabelValues(k).Set(1)
+			alive++
+		}
+	}
+	knownClients.Set(float64(alive))
+	c.logger.Info("Loaded client snapshot", "path", path, "clients", len(c.known), "alive", alive)
+	return nil
+}
+
+// runSnapshots periodically saves snapshots until ctx is done.
+func (c *memoryCoordinator) runSnapshots(ctx context.Context, path string) {
+	ticker := time.NewTicker(*snapshotInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := c.SaveSnapshot(path); err != nil {
+				c.logger.Error("Failed to save client snapshot", "err", err, "path", path)
+			}
+		}
+	}
+}
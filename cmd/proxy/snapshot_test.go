@@ -0,0 +1,73 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/promslog"
+)
+
+func TestSnapshot(t *testing.T) {
+	*registrationTimeout = 5 * time.Minute
+	*registrationRetention = time.Hour
+	path := filepath.Join(t.TempDir(), "clients.json")
+
+	c, err := NewMemoryCoordinator(promslog.NewNopLogger(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lastSeen := time.Now().Add(-10 * time.Minute).Round(0)
+	c.addKnownClient("alive")
+	c.addKnownClient("stale")
+	c.mu.Lock()
+	c.known["stale"] = lastSeen
+	c.mu.Unlock()
+	if err := c.SaveSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted, err := NewMemoryCoordinator(promslog.NewNopLogger(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := restarted.LoadSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+	if known := restarted.KnownClients(); len(known) != 1 || known[0] != "alive" {
+		t.Errorf("Expected [alive], got %v", known)
+	}
+	if !restarted.known["stale"].Equal(lastSeen) {
+		t.Errorf("Expected last seen time %s to be kept, got %s", lastSeen, restarted.known["stale"])
+	}
+}
+
+func TestSnapshotCorrupted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "clients.json")
+	if err := os.WriteFile(path, []byte("{\"version\":1,\"clients\":["), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewMemoryCoordinator(promslog.NewNopLogger(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.LoadSnapshot(path); err == nil {
+		t.Error("Expected error loading corrupted snapshot")
+	}
+	if known := c.KnownClients(); len(known) != 0 {
+		t.Errorf("Expected no clients, got %v", known)
+	}
+}
@@ -0,0 +1,313 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/prometheus-community/pushprox/util"
+)
+
+var (
+	sshListenAddress     = kingpin.Flag("ssh.listen-address", "Address to accept clients connecting via SSH on. Disabled if empty.").String()
+	sshHostKey           = kingpin.Flag("ssh.host-key", "Private host key of the SSH server.").String()
+	sshAuthorizedKeys    = kingpin.Flag("ssh.authorized-keys", "authorized_keys file of the clients allowed to connect via SSH, the comment of every key being the FQDN of its client.").String()
+	sshKeepaliveInterval = kingpin.Flag("ssh.keepalive-interval", "How often to check that clients connected via SSH are alive.").Default("30s").Duration()
+
+	openSSHConnections = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "ssh_connections",
+			Help:      "Number of clients connected via SSH.",
+		},
+	)
+)
+
+// sshFQDNExtension holds the FQDN of an authenticated client.
+const sshFQDNExtension = "pushprox-fqdn"
+
+// sshServer serves clients connecting via SSH like clients connected via a
+// stream, opening a channel to the client for every scrape.
+type sshServer struct {
+	h         *httpHandler
+	logger    *slog.Logger
+	config    *ssh.ServerConfig
+	keepalive time.Duration
+	ctx       context.Context
+	cancel    context.CancelFunc
+
+	mu    sync.Mutex
+	ln    net.Listener
+	conns map[*ssh.ServerConn]struct{}
+	wg    sync.WaitGroup
+}
+
+// loadAuthorizedKeys returns the FQDNs of the keys in an authorized_keys
+// file, by fingerprint.
+func loadAuthorizedKeys(path string) (map[string]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	keys := map[string]string{}
+	for len(bytes.TrimSpace(b)) > 0 {
+		key, comment, _, rest, err := ssh.ParseAuthorizedKey(b)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", path, err)
+		}
+		fqdn := strings.TrimSpace(comment)
+		if fqdn == "" {
+			return nil, fmt.Errorf("parsing %s: key %s lacks the FQDN of its client", path, ssh.FingerprintSHA256(key))
+		}
+		keys[ssh.FingerprintSHA256(key)] = fqdn
+		b = rest
+	}
+	return keys, nil
+}
+
+func newSSHServer(h *httpHandler, logger *slog.Logger, hostKeyFile, authorizedKeysFile string, keepalive time.Duration) (*sshServer, error) {
+	b, err := os.ReadFile(hostKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	hostKey, err := ssh.ParsePrivateKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", hostKeyFile, err)
+	}
+	keys, err := loadAuthorizedKeys(authorizedKeysFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			fqdn, ok := keys[ssh.FingerprintSHA256(key)]
+			if !ok {
+				return nil, fmt.Errorf("unknown key %s", ssh.FingerprintSHA256(key))
+			}
+			return &ssh.Permissions{Extensions: map[string]string{sshFQDNExtension: fqdn}}, nil
+		},
+	}
+	config.AddHostKey(hostKey)
+	ctx, cancel := context.WithCancel(context.Background())
+	return &sshServer{
+		h:         h,
+		logger:    logger,
+		config:    config,
+		keepalive: keepalive,
+		ctx:       ctx,
+		cancel:    cancel,
+		conns:     map[*ssh.ServerConn]struct{}{},
+	}, nil
+}
+
+// Serve accepts clients on ln until the server is closed.
+func (s *sshServer) Serve(ln net.Listener) error {
+	s.mu.Lock()
+	s.ln = ln
+	s.mu.Unlock()
+	for {
+		nc, err := ln.Accept()
+		if err != nil {
+			if s.ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handleConn(nc)
+		}()
+	}
+}
+
+func (s *sshServer) handleConn(nc net.Conn) {
+	// Bound the handshake, the connection is kept alive afterwards.
+	nc.SetDeadline(time.Now().Add(s.keepalive)) //nolint:errcheck
+	conn, chans, reqs, err := ssh.NewServerConn(nc, s.config)
+	if err != nil {
+		s.logger.Warn("SSH handshake failed", "remote_addr", nc.RemoteAddr().String(), "err", err)
+		nc.Close()
+		return
+	}
+	nc.SetDeadline(time.Time{}) //nolint:errcheck
+	defer conn.Close()
+	go ssh.DiscardRequests(reqs)
+	go func() {
+		for ch := range chans {
+			ch.Reject(ssh.Prohibited, "clients cannot open channels") //nolint:errcheck
+		}
+	}()
+	go util.SSHKeepalive(conn, s.keepalive)
+
+	s.mu.Lock()
+	if s.ctx.Err() != nil {
+		s.mu.Unlock()
+		return
+	}
+	s.conns[conn] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+	}()
+
+	fqdn := conn.Permissions.Extensions[sshFQDNExtension]
+	closed := make(chan struct{})
+	go func() {
+		conn.Wait() //nolint:errcheck
+		close(closed)
+	}()
+	if s.h.drainer.isDraining() {
+		// Like polls, hold the client until we are drained, rather than have
+		// it connect again and again.
+		select {
+		case <-s.h.drainer.drained:
+			s.reconnect(conn)
+		case <-closed:
+		}
+		return
+	}
+	s.h.identities.bind(fqdn, connIdentity(conn.RemoteAddr().String(), nil))
+	openSSHConnections.Inc()
+	defer openSSHConnections.Dec()
+	s.logger.Info("Client connected via SSH", "fqdn", fqdn, "remote_addr", conn.RemoteAddr().String())
+	s.h.serveScrapes(s.ctx, fqdn, &sshScrapeConn{conn: conn, logger: s.logger, results: make(chan *http.Response), closed: closed})
+	select {
+	case <-s.h.drainer.drained:
+		s.reconnect(conn)
+	default:
+	}
+	s.logger.Info("SSH connection closed", "fqdn", fqdn)
+}
+
+// reconnect asks the client to connect again right away, e.g. to another
+// replica, as we are going away.
+func (s *sshServer) reconnect(conn *ssh.ServerConn) {
+	if _, _, err := conn.SendRequest(util.SSHReconnectRequest, false, nil); err != nil {
+		s.logger.Warn("Error asking SSH client to reconnect", "err", err)
+	}
+}
+
+// Close stops accepting clients and disconnects the connected ones.
+func (s *sshServer) Close() {
+	s.cancel()
+	s.mu.Lock()
+	if s.ln != nil {
+		s.ln.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+// sshScrapeConn carries every scrape on a channel of its own.
+type sshScrapeConn struct {
+	conn    *ssh.ServerConn
+	logger  *slog.Logger
+	results chan *http.Response
+	// Closed once the connection is.
+	closed chan struct{}
+}
+
+func (c *sshScrapeConn) SendScrape(r *http.Request) error {
+	ch, reqs, err := c.conn.OpenChannel(util.SSHScrapeChannel, nil)
+	var openErr *ssh.OpenChannelError
+	if errors.As(err, &openErr) {
+		// The client is still there, but won't run the scrape.
+		c.logger.Warn("Client rejected scrape", "scrape_id", r.Header.Get("Id"), "err", err)
+		go c.deliver(&http.Response{
+			StatusCode: http.StatusServiceUnavailable,
+			Header:     http.Header{"Id": {r.Header.Get("Id")}},
+			Body:       io.NopCloser(strings.NewReader(fmt.Sprintf("Client rejected scrape: %s", openErr.Message))),
+		})
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	go ssh.DiscardRequests(reqs)
+	if err := r.WriteProxy(ch); err != nil {
+		ch.Close()
+		return err
+	}
+	ch.CloseWrite() //nolint:errcheck
+	go func() {
+		resp, err := http.ReadResponse(bufio.NewReader(ch), nil)
+		if err != nil {
+			ch.Close()
+			c.logger.Error("Error reading pushed response:", "err", err, "scrape_id", r.Header.Get("Id"))
+			return
+		}
+		// The body is read from the channel within the limits of pushes.
+		resp.Body = channelBody{ReadCloser: resp.Body, ch: ch}
+		if !c.deliver(resp) {
+			ch.Close()
+		}
+	}()
+	return nil
+}
+
+// channelBody is the body of a result read from its own channel.
+type channelBody struct {
+	io.ReadCloser
+	ch ssh.Channel
+}
+
+// Close closes the channel first, so that the rest of a rejected result is
+// not read.
+func (b channelBody) Close() error {
+	err := b.ch.Close()
+	b.ReadCloser.Close()
+	return err
+}
+
+// deliver hands a result to ReadResult. It returns false if the connection is
+// closed first.
+func (c *sshScrapeConn) deliver(resp *http.Response) bool {
+	select {
+	case c.results <- resp:
+		return true
+	case <-c.closed:
+		return false
+	}
+}
+
+func (c *sshScrapeConn) ReadResult() (*http.Response, error) {
+	select {
+	case r := <-c.results:
+		return r, nil
+	case <-c.closed:
+		return nil, io.EOF
+	}
+}
@@ -0,0 +1,226 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/promslog"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/prometheus-community/pushprox/util"
+)
+
+// newSSHKey returns a new key and its PEM encoding.
+func newSSHKey(t *testing.T) (ssh.Signer, []byte) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer, pem.EncodeToMemory(block)
+}
+
+func TestSSH(t *testing.T) {
+	ts, c := newProtocolTestProxy(t)
+	defer ts.Close()
+	h := ts.Config.Handler.(*httpHandler)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	dir := t.TempDir()
+	hostKey, hostPEM := newSSHKey(t)
+	clientKey, _ := newSSHKey(t)
+	otherKey, _ := newSSHKey(t)
+	if err := os.WriteFile(filepath.Join(dir, "host_key"), hostPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	authorized := append(bytes.TrimSpace(ssh.MarshalAuthorizedKey(clientKey.PublicKey())), " client.example.com\n"...)
+	if err := os.WriteFile(filepath.Join(dir, "authorized_keys"), authorized, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	s, err := newSSHServer(h, promslog.NewNopLogger(), filepath.Join(dir, "host_key"), filepath.Join(dir, "authorized_keys"), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(ln)
+	defer s.Close()
+
+	dial := func(key ssh.Signer) (*ssh.Client, error) {
+		return ssh.Dial("tcp", ln.Addr().String(), &ssh.ClientConfig{
+			User:            "client.example.com",
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(key)},
+			HostKeyCallback: ssh.FixedHostKey(hostKey.PublicKey()),
+		})
+	}
+	if _, err := dial(otherKey); err == nil {
+		t.Fatal("Expected an unknown key to be rejected")
+	}
+	client, err := dial(clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	// The client answers every scrape with its path, until told to reject
+	// them or to send an endless result.
+	var reject, endless atomic.Bool
+	go func() {
+		for newCh := range client.HandleChannelOpen(util.SSHScrapeChannel) {
+			if reject.Load() {
+				newCh.Reject(ssh.ResourceShortage, "too many scrapes")
+				continue
+			}
+			ch, reqs, err := newCh.Accept()
+			if err != nil {
+				continue
+			}
+			go ssh.DiscardRequests(reqs)
+			r, err := http.ReadRequest(bufio.NewReader(ch))
+			if err != nil {
+				t.Error(err)
+				ch.Close()
+				continue
+			}
+			if endless.Load() {
+				// Of unknown size, and never finished.
+				go func() {
+					fmt.Fprintf(ch, "HTTP/1.1 200 OK\r\nId: %s\r\n\r\n", r.Header.Get("Id"))
+					for {
+						if _, err := ch.Write(bytes.Repeat([]byte("a"), 1<<10)); err != nil {
+							return
+						}
+					}
+				}()
+				continue
+			}
+			ch.Write(scrapeResult(t, r))
+			ch.CloseWrite()
+		}
+	}()
+	for !c.IsKnown("client.example.com") {
+		if ctx.Err() != nil {
+			t.Fatal("Expected the client to be known by its key")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	results := queueScrapes(ctx, c, 2)
+	got := map[string]bool{<-results: true, <-results: true}
+	if !got["/0"] || !got["/1"] {
+		t.Errorf("Expected the results of both scrapes, got %v", got)
+	}
+
+	// A rejected scrape fails right away with the reason.
+	reject.Store(true)
+	start := time.Now()
+	r, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://client.example.com/metrics", nil)
+	resp, err := c.DoScrape(ctx, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusServiceUnavailable || !strings.Contains(string(body), "too many scrapes") {
+		t.Errorf("Expected a 503 with the reason, got %d: %q", resp.StatusCode, body)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Expected the scrape to fail right away, took %s", d)
+	}
+
+	// A result beyond --push.max-size fails its scrape once the limit is
+	// reached, rather than being read to the end.
+	reject.Store(false)
+	endless.Store(true)
+	*maxPushSize = 4 << 10
+	defer func() { *maxPushSize = 0 }()
+	r, _ = http.NewRequestWithContext(ctx, http.MethodGet, "http://client.example.com/metrics", nil)
+	resp, err = c.DoScrape(ctx, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected a 413, got %d: %q", resp.StatusCode, body)
+	}
+
+	// While draining, clients connecting are held until drained, and then
+	// asked to reconnect.
+	if !h.drainer.begin() {
+		t.Fatal("Expected to be able to start a scrape")
+	}
+	drained := make(chan error)
+	go func() {
+		drained <- h.Drain(context.Background())
+	}()
+	for !h.drainer.isDraining() {
+		time.Sleep(time.Millisecond)
+	}
+	nc, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	late, _, reqs, err := ssh.NewClientConn(nc, ln.Addr().String(), &ssh.ClientConfig{
+		User:            "client.example.com",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(clientKey)},
+		HostKeyCallback: ssh.FixedHostKey(hostKey.PublicKey()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer late.Close()
+	reconnect := make(chan bool, 1)
+	go func() {
+		asked := false
+		for req := range reqs {
+			asked = asked || req.Type == util.SSHReconnectRequest
+		}
+		reconnect <- asked
+	}()
+	select {
+	case <-reconnect:
+		t.Fatal("Expected the client to be held until drained")
+	case <-time.After(50 * time.Millisecond):
+	}
+	h.drainer.end()
+	if err := <-drained; err != nil {
+		t.Fatal(err)
+	}
+	if !<-reconnect {
+		t.Error("Expected the client to be asked to reconnect")
+	}
+}
@@ -0,0 +1,235 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/prometheus-community/pushprox/util"
+)
+
+var (
+	streamMaxFrameSize = kingpin.Flag("stream.max-frame-size", "Maximum size of a frame on a stream or WebSocket, i.e. of a single scrape result. Connections sending larger frames are closed.").Default("16MiB").Bytes()
+)
+
+var (
+	openStreams = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "streams",
+			Help:      "Number of clients connected via a stream.",
+		},
+	)
+)
+
+// handleStream handles clients exchanging scrapes and their results over a
+// single long-lived request, typically an HTTP/2 stream. Scrapes are sent
+// as soon as they arrive, so many can be in flight at once.
+func (h *httpHandler) handleStream(w http.ResponseWriter, r *http.Request) {
+	poll, err := util.DecodeStream(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error opening stream: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+	fqdn := poll.FQDN
+	if h.redirectToOwner(w, r, fqdn, "stream") || h.holdWhileDraining(w, r) {
+		return
+	}
+	openStreams.Inc()
+	defer openStreams.Dec()
+	resp := negotiate(poll)
+	h.limits.update(fqdn, resp.Capabilities[util.CapabilityScrapeLimit])
+	h.identities.bind(fqdn, clientIdentity(r))
+
+	rc := http.NewResponseController(w)
+	// Only needed for HTTP/1.1, HTTP/2 streams are always full duplex.
+	rc.EnableFullDuplex() //nolint:errcheck
+	util.WriteStreamHeader(w, resp.Version, resp.Capabilities)
+	if err := rc.Flush(); err != nil {
+		h.logger.Warn("Error opening stream", "fqdn", fqdn, "err", err)
+		return
+	}
+	h.logger.Info("Opened stream", "fqdn", fqdn)
+	fr := util.NewFrameReader(r.Body)
+	fr.SetReadLimit(int64(*streamMaxFrameSize))
+	h.serveScrapes(r.Context(), fqdn, &frameScrapeConn{
+		frameConn: struct {
+			*util.FrameReader
+			*util.FrameWriter
+		}{fr, util.NewFrameWriter(w, rc.Flush)},
+		logger: h.logger,
+	})
+	h.logger.Info("Closed stream", "fqdn", fqdn)
+}
+
+// scrapeConn carries scrapes to a connected client and their results back.
+type scrapeConn interface {
+	// SendScrape sends a scrape to the client.
+	SendScrape(r *http.Request) error
+	// ReadResult returns the next scrape result, or io.EOF once the client
+	// closed its side. The body of the result may be read from the
+	// connection, so it is only valid until the next call.
+	ReadResult() (*http.Response, error)
+}
+
+// frameConn exchanges frames with a client.
+type frameConn interface {
+	NextFrame() (byte, io.Reader, error)
+	WriteFrame(typ byte, payload []byte) error
+}
+
+// frameScrapeConn carries scrapes and results as frames in HTTP wire format.
+type frameScrapeConn struct {
+	frameConn
+	logger *slog.Logger
+}
+
+func (c *frameScrapeConn) SendScrape(r *http.Request) error {
+	buf := &bytes.Buffer{}
+	if err := r.WriteProxy(buf); err != nil {
+		return err
+	}
+	return c.WriteFrame(util.FrameScrapeRequest, buf.Bytes())
+}
+
+func (c *frameScrapeConn) ReadResult() (*http.Response, error) {
+	for {
+		typ, payload, err := c.NextFrame()
+		if err != nil {
+			return nil, err
+		}
+		if typ != util.FrameScrapeResponse {
+			c.logger.Warn("Ignoring unexpected frame on stream", "type", typ)
+			continue
+		}
+		// The body is streamed from the frame rather than held in memory.
+		scrapeResult, err := http.ReadResponse(bufio.NewReader(payload), nil)
+		if err != nil {
+			c.logger.Error("Error reading pushed response:", "err", err)
+			continue
+		}
+		return scrapeResult, nil
+	}
+}
+
+// serveScrapes sends scrapes for fqdn to conn as they arrive, and hands the
+// results read from conn to the waiting scrapes, until the client goes away
+// or we are drained.
+func (h *httpHandler) serveScrapes(ctx context.Context, fqdn string, conn scrapeConn) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan error, 1)
+	go func() {
+		results <- h.readResults(conn)
+	}()
+	go func() {
+		select {
+		case <-h.drainer.drained:
+			cancel()
+		case err := <-results:
+			// The client closed its side.
+			results <- err
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	for {
+		// Wait in slices, so that the client's registration is renewed
+		// while no scrapes come in.
+		waitCtx, waitCancel := context.WithTimeout(ctx, *registrationTimeout/2)
+		request, err := h.coordinator.WaitForScrapeInstruction(waitCtx, fqdn)
+		waitCancel()
+		if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+			continue
+		}
+		if err != nil {
+			break
+		}
+		_, span := tracer.Start(request.Context(), "stream delivery", trace.WithAttributes(attribute.String("fqdn", fqdn)))
+		err = conn.SendScrape(request)
+		span.End()
+		if err != nil {
+			h.logger.Warn("Error writing to stream", "fqdn", fqdn, "err", err)
+			return
+		}
+		h.logger.Info("Sent scrape on stream", "url", request.URL.String(), "scrape_id", request.Header.Get("Id"))
+	}
+}
+
+// readResults hands the results read from conn to the waiting scrapes, until
+// the client closes its side.
+func (h *httpHandler) readResults(conn scrapeConn) error {
+	for {
+		scrapeResult, err := conn.ReadResult()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		h.logger.Info("Got result on stream", "scrape_id", scrapeResult.Header.Get("Id"))
+		if err := h.handleResult(scrapeResult); err != nil {
+			return err
+		}
+	}
+}
+
+// handleResult hands a result read from a connection to its scrape within the
+// limits of pushes. The result is read into memory first, so that the next
+// result on the connection need not wait for the scrape to copy it. It only
+// fails if the result could not be read.
+func (h *httpHandler) handleResult(scrapeResult *http.Response) error {
+	scrapeId := scrapeResult.Header.Get("Id")
+	limited, err := h.limitResult(scrapeResult)
+	if rejected := limited.rejected(); rejected != nil {
+		limited.release()
+		h.logger.Warn("Rejected result:", "err", rejected, "scrape_id", scrapeId)
+		if err := h.failResult(scrapeResult, rejected); err != nil {
+			h.logger.Error("Error failing scrape:", "err", err, "scrape_id", scrapeId)
+		}
+		return nil
+	}
+	if err != nil {
+		limited.release()
+		return err
+	}
+	body := newPushedBody(scrapeResult.Body)
+	scrapeResult.Body = body
+	if err := h.coordinator.ScrapeResult(scrapeResult); err != nil {
+		limited.release()
+		h.logger.Error("Error pushing:", "err", err, "scrape_id", scrapeId)
+		return nil
+	}
+	// The result counts against the budget until the scrape copied it. The
+	// scrape always reads or closes a result it was handed.
+	go func() {
+		defer limited.release()
+		if err := body.wait(context.Background()); err != nil {
+			h.logger.Warn("Error streaming result:", "err", err, "scrape_id", scrapeId)
+		}
+	}()
+	return nil
+}
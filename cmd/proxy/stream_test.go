@@ -0,0 +1,203 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/promslog"
+
+	"github.com/prometheus-community/pushprox/util"
+)
+
+func TestStream(t *testing.T) {
+	*registrationTimeout = 5 * time.Minute
+	*maxScrapeTimeout = time.Minute
+	*defaultScrapeTimeout = 10 * time.Second
+	*streamMaxFrameSize = 16 << 20
+	c, err := NewMemoryCoordinator(promslog.NewNopLogger(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newHTTPHandler(promslog.NewNopLogger(), c, nil, nil, http.NewServeMux())
+	ts := httptest.NewUnstartedServer(h)
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	req, err := util.NewStreamRequest(ctx, ts.URL+"/stream", util.Poll{FQDN: "client.example.com", Version: util.ProtocolVersion}, pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Errorf("Expected an HTTP/2 stream, got %s", resp.Proto)
+	}
+	if version, _ := util.ReadStreamHeader(resp); version != util.ProtocolVersion {
+		t.Errorf("Expected protocol version %d, got %d", util.ProtocolVersion, version)
+	}
+
+	// Several scrapes are in flight on the stream at once.
+	const scrapes = 3
+	results := queueScrapes(ctx, c, scrapes)
+	fr := util.NewFrameReader(resp.Body)
+	fw := util.NewFrameWriter(pw, nil)
+	var requests []*http.Request
+	for range scrapes {
+		typ, payload, err := fr.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if typ != util.FrameScrapeRequest {
+			t.Fatalf("Expected a scrape request, got frame type %d", typ)
+		}
+		r, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(payload)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		requests = append(requests, r)
+	}
+	for _, r := range requests {
+		if err := fw.WriteFrame(util.FrameScrapeResponse, scrapeResult(t, r)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := map[string]bool{}
+	for range scrapes {
+		got[<-results] = true
+	}
+	for _, r := range requests {
+		if !got[r.URL.Path] {
+			t.Errorf("Expected result for %s, got %v", r.URL.Path, got)
+		}
+	}
+	if !c.IsKnown("client.example.com") {
+		t.Error("Expected the streaming client to be known")
+	}
+}
+
+func TestStreamFrameLimit(t *testing.T) {
+	ts, c := newProtocolTestProxy(t)
+	defer ts.Close()
+	*streamMaxFrameSize = 1 << 10
+	defer func() { *streamMaxFrameSize = 16 << 20 }()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	req, err := util.NewStreamRequest(ctx, ts.URL+"/stream", util.Poll{FQDN: "client.example.com", Version: util.ProtocolVersion}, pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	queueScrapes(ctx, c, 1)
+	fr := util.NewFrameReader(resp.Body)
+	if _, _, err := fr.ReadFrame(); err != nil {
+		t.Fatal(err)
+	}
+	go util.NewFrameWriter(pw, nil).WriteFrame(util.FrameScrapeResponse, bytes.Repeat([]byte("a"), 4<<10)) //nolint:errcheck
+	if _, _, err := fr.ReadFrame(); !errors.Is(err, io.EOF) {
+		t.Errorf("Expected the stream to be closed, got %v", err)
+	}
+}
+
+func TestStreamStalledReader(t *testing.T) {
+	ts, c := newProtocolTestProxy(t)
+	defer ts.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	req, err := util.NewStreamRequest(ctx, ts.URL+"/stream", util.Poll{FQDN: "client.example.com", Version: util.ProtocolVersion}, pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// The first scrape doesn't read its result for now.
+	stalled := make(chan *http.Response, 1)
+	go func() {
+		r, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://client.example.com/stalled", nil)
+		resp, err := c.DoScrape(ctx, r)
+		if err != nil {
+			t.Error(err)
+			close(stalled)
+			return
+		}
+		stalled <- resp
+	}()
+	fr := util.NewFrameReader(resp.Body)
+	readScrape := func() *http.Request {
+		_, payload, err := fr.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(payload)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	fw := util.NewFrameWriter(pw, nil)
+	if err := fw.WriteFrame(util.FrameScrapeResponse, scrapeResult(t, readScrape())); err != nil {
+		t.Fatal(err)
+	}
+	stalledResp := <-stalled
+	if stalledResp == nil {
+		return
+	}
+	defer stalledResp.Body.Close()
+
+	// The result of the next scrape on the stream still gets through.
+	results := queueScrapes(ctx, c, 1)
+	if err := fw.WriteFrame(util.FrameScrapeResponse, scrapeResult(t, readScrape())); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-results:
+		if got != "/0" {
+			t.Errorf("Expected the result of the second scrape, got %q", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the second result not to wait for the first to be read")
+	}
+	body, _ := io.ReadAll(stalledResp.Body)
+	if string(body) != "/stalled" {
+		t.Errorf("Expected the stalled result to be intact, got %q", body)
+	}
+}
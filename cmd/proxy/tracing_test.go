@@ -0,0 +1,111 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/promslog"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/prometheus-community/pushprox/util"
+)
+
+var (
+	testSpans        = tracetest.NewInMemoryExporter()
+	setupTestTracing sync.Once
+)
+
+func TestProxyTracing(t *testing.T) {
+	// The global tracer only binds to the first provider set.
+	setupTestTracing.Do(func() {
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(testSpans)))
+	})
+	testSpans.Reset()
+	*maxScrapeTimeout = time.Minute
+	*defaultScrapeTimeout = 10 * time.Second
+	if _, err := util.SetupTracing(context.Background(), "test", util.TracingConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewMemoryCoordinator(promslog.NewNopLogger(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newHTTPHandler(promslog.NewNopLogger(), c, nil, nil, http.NewServeMux())
+
+	// The client polls, and pushes the result with the trace context it got.
+	polled := make(chan string, 1)
+	go func() {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/poll", strings.NewReader("traced.example")))
+		request, err := http.ReadRequest(bufio.NewReader(w.Body))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		polled <- request.Header.Get("Traceparent")
+		result := &http.Response{
+			StatusCode: http.StatusOK,
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     http.Header{"Id": {request.Header.Get("Id")}},
+			Body:       io.NopCloser(strings.NewReader("up 1\n")),
+		}
+		buf := &bytes.Buffer{}
+		if err := result.Write(buf); err != nil {
+			t.Error(err)
+			return
+		}
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/push", buf))
+	}()
+
+	// The trace as started by Prometheus.
+	parentCtx, parent := otel.Tracer("test").Start(context.Background(), "prometheus scrape")
+	parent.End()
+	r := httptest.NewRequest(http.MethodGet, "http://traced.example/metrics", nil)
+	util.InjectTraceContext(parentCtx, r.Header)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected scrape to succeed, got %d: %s", w.Code, w.Body)
+	}
+
+	traceID := parent.SpanContext().TraceID()
+	names := map[string]bool{}
+	for _, span := range testSpans.GetSpans() {
+		if span.SpanContext.TraceID() == traceID {
+			names[span.Name] = true
+		}
+	}
+	for _, name := range []string{"proxy scrape", "queue", "poll delivery", "wait for result"} {
+		if !names[name] {
+			t.Errorf("Missing span %q, got %v", name, names)
+		}
+	}
+	clientCtx := util.ExtractTraceContext(context.Background(), http.Header{"Traceparent": {<-polled}})
+	if got := trace.SpanContextFromContext(clientCtx).TraceID(); got != traceID {
+		t.Errorf("Expected trace %s to be forwarded to the client, got %s", traceID, got)
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/prometheus-community/pushprox/util"
+)
+
+var (
+	websocketPingInterval = kingpin.Flag("websocket.ping-interval", "How often to ping clients connected via WebSocket. Connections not answering within twice this are closed.").Default("30s").Duration()
+
+	openWebSockets = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "websockets",
+			Help:      "Number of clients connected via a WebSocket.",
+		},
+	)
+
+	// Clients aren't browsers, so there is no origin to check.
+	upgrader = websocket.Upgrader{CheckOrigin: func(*http.Request) bool { return true }}
+)
+
+// handleWebSocket handles clients exchanging scrapes and their results over a
+// WebSocket, for networks where HTTP proxies get in the way of long polls and
+// HTTP/2 streams.
+func (h *httpHandler) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	poll, err := util.DecodeStream(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error opening WebSocket: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+	fqdn := poll.FQDN
+	if h.redirectToOwner(w, r, fqdn, "websocket") || h.holdWhileDraining(w, r) {
+		return
+	}
+	resp := negotiate(poll)
+	header := http.Header{}
+	header.Set(util.ProtocolVersionHeader, strconv.Itoa(resp.Version))
+	header.Set(util.CapabilitiesHeader, resp.Capabilities.String())
+	ws, err := upgrader.Upgrade(w, r, header)
+	if err != nil {
+		// The upgrader already replied.
+		h.logger.Warn("Error opening WebSocket", "fqdn", fqdn, "err", err)
+		return
+	}
+	openWebSockets.Inc()
+	defer openWebSockets.Dec()
+	h.limits.update(fqdn, resp.Capabilities[util.CapabilityScrapeLimit])
+	h.identities.bind(fqdn, clientIdentity(r))
+
+	conn := util.NewWebSocketConn(ws, *websocketPingInterval, int64(*streamMaxFrameSize))
+	defer conn.Close()
+	h.logger.Info("Opened WebSocket", "fqdn", fqdn)
+	h.serveScrapes(r.Context(), fqdn, &frameScrapeConn{frameConn: conn, logger: h.logger})
+	h.logger.Info("Closed WebSocket", "fqdn", fqdn)
+}
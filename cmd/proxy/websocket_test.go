@@ -0,0 +1,116 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/prometheus-community/pushprox/util"
+)
+
+// dialTestWebSocket connects to the proxy as client.example.com. The
+// connection is closed at the end of the test, waiting for the proxy to let
+// go of it, as httptest doesn't track hijacked connections.
+func dialTestWebSocket(ctx context.Context, t *testing.T, ts *httptest.Server) (*util.WebSocketConn, *http.Response) {
+	poll := util.Poll{FQDN: "client.example.com", Version: util.ProtocolVersion}
+	ws, resp, err := websocket.DefaultDialer.DialContext(ctx, "ws"+strings.TrimPrefix(ts.URL, "http")+"/websocket", util.StreamHeader(poll))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := util.NewWebSocketConn(ws, time.Minute, util.DefaultFrameReadLimit)
+	t.Cleanup(func() {
+		conn.Close()
+		for testutil.ToFloat64(openWebSockets) != 0 {
+			time.Sleep(time.Millisecond)
+		}
+	})
+	return conn, resp
+}
+
+func TestWebSocket(t *testing.T) {
+	ts, c := newProtocolTestProxy(t)
+	defer ts.Close()
+	*websocketPingInterval = time.Minute
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, resp := dialTestWebSocket(ctx, t, ts)
+	if version, _ := util.ReadStreamHeader(resp); version != util.ProtocolVersion {
+		t.Errorf("Expected protocol version %d, got %d", util.ProtocolVersion, version)
+	}
+
+	const scrapes = 3
+	results := queueScrapes(ctx, c, scrapes)
+	var requests []*http.Request
+	for range scrapes {
+		typ, payload, err := conn.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if typ != util.FrameScrapeRequest {
+			t.Fatalf("Expected a scrape request, got frame type %d", typ)
+		}
+		r, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(payload)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		requests = append(requests, r)
+	}
+	for _, r := range requests {
+		if err := conn.WriteFrame(util.FrameScrapeResponse, scrapeResult(t, r)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := map[string]bool{}
+	for range scrapes {
+		got[<-results] = true
+	}
+	for _, r := range requests {
+		if !got[r.URL.Path] {
+			t.Errorf("Expected result for %s, got %v", r.URL.Path, got)
+		}
+	}
+}
+
+func TestWebSocketReadLimit(t *testing.T) {
+	ts, c := newProtocolTestProxy(t)
+	defer ts.Close()
+	*websocketPingInterval = time.Minute
+	*streamMaxFrameSize = 1 << 10
+	defer func() { *streamMaxFrameSize = 16 << 20 }()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, _ := dialTestWebSocket(ctx, t, ts)
+
+	queueScrapes(ctx, c, 1)
+	if _, _, err := conn.ReadFrame(); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.WriteFrame(util.FrameScrapeResponse, bytes.Repeat([]byte("a"), 4<<10)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := conn.ReadFrame(); err == nil {
+		t.Error("Expected the proxy to close the WebSocket")
+	}
+}
@@ -0,0 +1,678 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.11
+// 	protoc        (unknown)
+// source: pushprox.proto
+
+package pushproxpb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	durationpb "google.golang.org/protobuf/types/known/durationpb"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type ClientMessage struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Types that are valid to be assigned to Message:
+	//
+	//	*ClientMessage_Hello
+	//	*ClientMessage_Result
+	Message       isClientMessage_Message `protobuf_oneof:"message"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ClientMessage) Reset() {
+	*x = ClientMessage{}
+	mi := &file_pushprox_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ClientMessage) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ClientMessage) ProtoMessage() {}
+
+func (x *ClientMessage) ProtoReflect() protoreflect.Message {
+	mi := &file_pushprox_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ClientMessage.ProtoReflect.Descriptor instead.
+func (*ClientMessage) Descriptor() ([]byte, []int) {
+	return file_pushprox_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *ClientMessage) GetMessage() isClientMessage_Message {
+	if x != nil {
+		return x.Message
+	}
+	return nil
+}
+
+func (x *ClientMessage) GetHello() *Hello {
+	if x != nil {
+		if x, ok := x.Message.(*ClientMessage_Hello); ok {
+			return x.Hello
+		}
+	}
+	return nil
+}
+
+func (x *ClientMessage) GetResult() *ScrapeResult {
+	if x != nil {
+		if x, ok := x.Message.(*ClientMessage_Result); ok {
+			return x.Result
+		}
+	}
+	return nil
+}
+
+type isClientMessage_Message interface {
+	isClientMessage_Message()
+}
+
+type ClientMessage_Hello struct {
+	Hello *Hello `protobuf:"bytes,1,opt,name=hello,proto3,oneof"`
+}
+
+type ClientMessage_Result struct {
+	Result *ScrapeResult `protobuf:"bytes,2,opt,name=result,proto3,oneof"`
+}
+
+func (*ClientMessage_Hello) isClientMessage_Message() {}
+
+func (*ClientMessage_Result) isClientMessage_Message() {}
+
+type Hello struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	Fqdn  string                 `protobuf:"bytes,1,opt,name=fqdn,proto3" json:"fqdn,omitempty"`
+	// Maximum number of concurrent scrapes the client accepts, 0 for no limit.
+	ScrapeLimit   int32 `protobuf:"varint,2,opt,name=scrape_limit,json=scrapeLimit,proto3" json:"scrape_limit,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Hello) Reset() {
+	*x = Hello{}
+	mi := &file_pushprox_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Hello) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Hello) ProtoMessage() {}
+
+func (x *Hello) ProtoReflect() protoreflect.Message {
+	mi := &file_pushprox_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Hello.ProtoReflect.Descriptor instead.
+func (*Hello) Descriptor() ([]byte, []int) {
+	return file_pushprox_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *Hello) GetFqdn() string {
+	if x != nil {
+		return x.Fqdn
+	}
+	return ""
+}
+
+func (x *Hello) GetScrapeLimit() int32 {
+	if x != nil {
+		return x.ScrapeLimit
+	}
+	return 0
+}
+
+type Header struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Name          string                 `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	Values        []string               `protobuf:"bytes,2,rep,name=values,proto3" json:"values,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Header) Reset() {
+	*x = Header{}
+	mi := &file_pushprox_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Header) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Header) ProtoMessage() {}
+
+func (x *Header) ProtoReflect() protoreflect.Message {
+	mi := &file_pushprox_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Header.ProtoReflect.Descriptor instead.
+func (*Header) Descriptor() ([]byte, []int) {
+	return file_pushprox_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *Header) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *Header) GetValues() []string {
+	if x != nil {
+		return x.Values
+	}
+	return nil
+}
+
+type ScrapeInstruction struct {
+	state   protoimpl.MessageState `protogen:"open.v1"`
+	Id      string                 `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Method  string                 `protobuf:"bytes,2,opt,name=method,proto3" json:"method,omitempty"`
+	Url     string                 `protobuf:"bytes,3,opt,name=url,proto3" json:"url,omitempty"`
+	Headers []*Header              `protobuf:"bytes,4,rep,name=headers,proto3" json:"headers,omitempty"`
+	// Time left until Prometheus gives up on the scrape.
+	Timeout       *durationpb.Duration `protobuf:"bytes,5,opt,name=timeout,proto3" json:"timeout,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ScrapeInstruction) Reset() {
+	*x = ScrapeInstruction{}
+	mi := &file_pushprox_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ScrapeInstruction) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ScrapeInstruction) ProtoMessage() {}
+
+func (x *ScrapeInstruction) ProtoReflect() protoreflect.Message {
+	mi := &file_pushprox_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ScrapeInstruction.ProtoReflect.Descriptor instead.
+func (*ScrapeInstruction) Descriptor() ([]byte, []int) {
+	return file_pushprox_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *ScrapeInstruction) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *ScrapeInstruction) GetMethod() string {
+	if x != nil {
+		return x.Method
+	}
+	return ""
+}
+
+func (x *ScrapeInstruction) GetUrl() string {
+	if x != nil {
+		return x.Url
+	}
+	return ""
+}
+
+func (x *ScrapeInstruction) GetHeaders() []*Header {
+	if x != nil {
+		return x.Headers
+	}
+	return nil
+}
+
+func (x *ScrapeInstruction) GetTimeout() *durationpb.Duration {
+	if x != nil {
+		return x.Timeout
+	}
+	return nil
+}
+
+type ScrapeResult struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Id            string                 `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	StatusCode    int32                  `protobuf:"varint,2,opt,name=status_code,json=statusCode,proto3" json:"status_code,omitempty"`
+	Headers       []*Header              `protobuf:"bytes,3,rep,name=headers,proto3" json:"headers,omitempty"`
+	Body          []byte                 `protobuf:"bytes,4,opt,name=body,proto3" json:"body,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ScrapeResult) Reset() {
+	*x = ScrapeResult{}
+	mi := &file_pushprox_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ScrapeResult) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ScrapeResult) ProtoMessage() {}
+
+func (x *ScrapeResult) ProtoReflect() protoreflect.Message {
+	mi := &file_pushprox_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ScrapeResult.ProtoReflect.Descriptor instead.
+func (*ScrapeResult) Descriptor() ([]byte, []int) {
+	return file_pushprox_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *ScrapeResult) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *ScrapeResult) GetStatusCode() int32 {
+	if x != nil {
+		return x.StatusCode
+	}
+	return 0
+}
+
+func (x *ScrapeResult) GetHeaders() []*Header {
+	if x != nil {
+		return x.Headers
+	}
+	return nil
+}
+
+func (x *ScrapeResult) GetBody() []byte {
+	if x != nil {
+		return x.Body
+	}
+	return nil
+}
+
+type ListClientsRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Also list clients whose registration expired.
+	Stale         bool `protobuf:"varint,1,opt,name=stale,proto3" json:"stale,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListClientsRequest) Reset() {
+	*x = ListClientsRequest{}
+	mi := &file_pushprox_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListClientsRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListClientsRequest) ProtoMessage() {}
+
+func (x *ListClientsRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_pushprox_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListClientsRequest.ProtoReflect.Descriptor instead.
+func (*ListClientsRequest) Descriptor() ([]byte, []int) {
+	return file_pushprox_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *ListClientsRequest) GetStale() bool {
+	if x != nil {
+		return x.Stale
+	}
+	return false
+}
+
+type Client struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Fqdn          string                 `protobuf:"bytes,1,opt,name=fqdn,proto3" json:"fqdn,omitempty"`
+	Stale         bool                   `protobuf:"varint,2,opt,name=stale,proto3" json:"stale,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Client) Reset() {
+	*x = Client{}
+	mi := &file_pushprox_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Client) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Client) ProtoMessage() {}
+
+func (x *Client) ProtoReflect() protoreflect.Message {
+	mi := &file_pushprox_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Client.ProtoReflect.Descriptor instead.
+func (*Client) Descriptor() ([]byte, []int) {
+	return file_pushprox_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *Client) GetFqdn() string {
+	if x != nil {
+		return x.Fqdn
+	}
+	return ""
+}
+
+func (x *Client) GetStale() bool {
+	if x != nil {
+		return x.Stale
+	}
+	return false
+}
+
+type ListClientsResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Clients       []*Client              `protobuf:"bytes,1,rep,name=clients,proto3" json:"clients,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListClientsResponse) Reset() {
+	*x = ListClientsResponse{}
+	mi := &file_pushprox_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListClientsResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListClientsResponse) ProtoMessage() {}
+
+func (x *ListClientsResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_pushprox_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListClientsResponse.ProtoReflect.Descriptor instead.
+func (*ListClientsResponse) Descriptor() ([]byte, []int) {
+	return file_pushprox_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *ListClientsResponse) GetClients() []*Client {
+	if x != nil {
+		return x.Clients
+	}
+	return nil
+}
+
+type ScrapeRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// URL of the target, its host being the FQDN of the client.
+	Url           string    `protobuf:"bytes,1,opt,name=url,proto3" json:"url,omitempty"`
+	Headers       []*Header `protobuf:"bytes,2,rep,name=headers,proto3" json:"headers,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ScrapeRequest) Reset() {
+	*x = ScrapeRequest{}
+	mi := &file_pushprox_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ScrapeRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ScrapeRequest) ProtoMessage() {}
+
+func (x *ScrapeRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_pushprox_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ScrapeRequest.ProtoReflect.Descriptor instead.
+func (*ScrapeRequest) Descriptor() ([]byte, []int) {
+	return file_pushprox_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *ScrapeRequest) GetUrl() string {
+	if x != nil {
+		return x.Url
+	}
+	return ""
+}
+
+func (x *ScrapeRequest) GetHeaders() []*Header {
+	if x != nil {
+		return x.Headers
+	}
+	return nil
+}
+
+var File_pushprox_proto protoreflect.FileDescriptor
+
+const file_pushprox_proto_rawDesc = "" +
+	"\n" +
+	"\x0epushprox.proto\x12\vpushprox.v1\x1a\x1egoogle/protobuf/duration.proto\"{\n" +
+	"\rClientMessage\x12*\n" +
+	"\x05hello\x18\x01 \x01(\v2\x12.pushprox.v1.HelloH\x00R\x05hello\x123\n" +
+	"\x06result\x18\x02 \x01(\v2\x19.pushprox.v1.ScrapeResultH\x00R\x06resultB\t\n" +
+	"\amessage\">\n" +
+	"\x05Hello\x12\x12\n" +
+	"\x04fqdn\x18\x01 \x01(\tR\x04fqdn\x12!\n" +
+	"\fscrape_limit\x18\x02 \x01(\x05R\vscrapeLimit\"4\n" +
+	"\x06Header\x12\x12\n" +
+	"\x04name\x18\x01 \x01(\tR\x04name\x12\x16\n" +
+	"\x06values\x18\x02 \x03(\tR\x06values\"\xb1\x01\n" +
+	"\x11ScrapeInstruction\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\tR\x02id\x12\x16\n" +
+	"\x06method\x18\x02 \x01(\tR\x06method\x12\x10\n" +
+	"\x03url\x18\x03 \x01(\tR\x03url\x12-\n" +
+	"\aheaders\x18\x04 \x03(\v2\x13.pushprox.v1.HeaderR\aheaders\x123\n" +
+	"\atimeout\x18\x05 \x01(\v2\x19.google.protobuf.DurationR\atimeout\"\x82\x01\n" +
+	"\fScrapeResult\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\tR\x02id\x12\x1f\n" +
+	"\vstatus_code\x18\x02 \x01(\x05R\n" +
+	"statusCode\x12-\n" +
+	"\aheaders\x18\x03 \x03(\v2\x13.pushprox.v1.HeaderR\aheaders\x12\x12\n" +
+	"\x04body\x18\x04 \x01(\fR\x04body\"*\n" +
+	"\x12ListClientsRequest\x12\x14\n" +
+	"\x05stale\x18\x01 \x01(\bR\x05stale\"2\n" +
+	"\x06Client\x12\x12\n" +
+	"\x04fqdn\x18\x01 \x01(\tR\x04fqdn\x12\x14\n" +
+	"\x05stale\x18\x02 \x01(\bR\x05stale\"D\n" +
+	"\x13ListClientsResponse\x12-\n" +
+	"\aclients\x18\x01 \x03(\v2\x13.pushprox.v1.ClientR\aclients\"P\n" +
+	"\rScrapeRequest\x12\x10\n" +
+	"\x03url\x18\x01 \x01(\tR\x03url\x12-\n" +
+	"\aheaders\x18\x02 \x03(\v2\x13.pushprox.v1.HeaderR\aheaders2\xe8\x01\n" +
+	"\bPushProx\x12I\n" +
+	"\aConnect\x12\x1a.pushprox.v1.ClientMessage\x1a\x1e.pushprox.v1.ScrapeInstruction(\x010\x01\x12P\n" +
+	"\vListClients\x12\x1f.pushprox.v1.ListClientsRequest\x1a .pushprox.v1.ListClientsResponse\x12?\n" +
+	"\x06Scrape\x12\x1a.pushprox.v1.ScrapeRequest\x1a\x19.pushprox.v1.ScrapeResultB5Z3github.com/prometheus-community/pushprox/pushproxpbb\x06proto3"
+
+var (
+	file_pushprox_proto_rawDescOnce sync.Once
+	file_pushprox_proto_rawDescData []byte
+)
+
+func file_pushprox_proto_rawDescGZIP() []byte {
+	file_pushprox_proto_rawDescOnce.Do(func() {
+		file_pushprox_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_pushprox_proto_rawDesc), len(file_pushprox_proto_rawDesc)))
+	})
+	return file_pushprox_proto_rawDescData
+}
+
+var file_pushprox_proto_msgTypes = make([]protoimpl.MessageInfo, 9)
+var file_pushprox_proto_goTypes = []any{
+	(*ClientMessage)(nil),       // 0: pushprox.v1.ClientMessage
+	(*Hello)(nil),               // 1: pushprox.v1.Hello
+	(*Header)(nil),              // 2: pushprox.v1.Header
+	(*ScrapeInstruction)(nil),   // 3: pushprox.v1.ScrapeInstruction
+	(*ScrapeResult)(nil),        // 4: pushprox.v1.ScrapeResult
+	(*ListClientsRequest)(nil),  // 5: pushprox.v1.ListClientsRequest
+	(*Client)(nil),              // 6: pushprox.v1.Client
+	(*ListClientsResponse)(nil), // 7: pushprox.v1.ListClientsResponse
+	(*ScrapeRequest)(nil),       // 8: pushprox.v1.ScrapeRequest
+	(*durationpb.Duration)(nil), // 9: google.protobuf.Duration
+}
+var file_pushprox_proto_depIdxs = []int32{
+	1,  // 0: pushprox.v1.ClientMessage.hello:type_name -> pushprox.v1.Hello
+	4,  // 1: pushprox.v1.ClientMessage.result:type_name -> pushprox.v1.ScrapeResult
+	2,  // 2: pushprox.v1.ScrapeInstruction.headers:type_name -> pushprox.v1.Header
+	9,  // 3: pushprox.v1.ScrapeInstruction.timeout:type_name -> google.protobuf.Duration
+	2,  // 4: pushprox.v1.ScrapeResult.headers:type_name -> pushprox.v1.Header
+	6,  // 5: pushprox.v1.ListClientsResponse.clients:type_name -> pushprox.v1.Client
+	2,  // 6: pushprox.v1.ScrapeRequest.headers:type_name -> pushprox.v1.Header
+	0,  // 7: pushprox.v1.PushProx.Connect:input_type -> pushprox.v1.ClientMessage
+	5,  // 8: pushprox.v1.PushProx.ListClients:input_type -> pushprox.v1.ListClientsRequest
+	8,  // 9: pushprox.v1.PushProx.Scrape:input_type -> pushprox.v1.ScrapeRequest
+	3,  // 10: pushprox.v1.PushProx.Connect:output_type -> pushprox.v1.ScrapeInstruction
+	7,  // 11: pushprox.v1.PushProx.ListClients:output_type -> pushprox.v1.ListClientsResponse
+	4,  // 12: pushprox.v1.PushProx.Scrape:output_type -> pushprox.v1.ScrapeResult
+	10, // [10:13] is the sub-list for method output_type
+	7,  // [7:10] is the sub-list for method input_type
+	7,  // [7:7] is the sub-list for extension type_name
+	7,  // [7:7] is the sub-list for extension extendee
+	0,  // [0:7] is the sub-list for field type_name
+}
+
+func init() { file_pushprox_proto_init() }
+func file_pushprox_proto_init() {
+	if File_pushprox_proto != nil {
+		return
+	}
+	file_pushprox_proto_msgTypes[0].OneofWrappers = []any{
+		(*ClientMessage_Hello)(nil),
+		(*ClientMessage_Result)(nil),
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_pushprox_proto_rawDesc), len(file_pushprox_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   9,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_pushprox_proto_goTypes,
+		DependencyIndexes: file_pushprox_proto_depIdxs,
+		MessageInfos:      file_pushprox_proto_msgTypes,
+	}.Build()
+	File_pushprox_proto = out.File
+	file_pushprox_proto_goTypes = nil
+	file_pushprox_proto_depIdxs = nil
+}
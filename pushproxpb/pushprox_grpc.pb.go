@@ -0,0 +1,219 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: pushprox.proto
+
+package pushproxpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	PushProx_Connect_FullMethodName     = "/pushprox.v1.PushProx/Connect"
+	PushProx_ListClients_FullMethodName = "/pushprox.v1.PushProx/ListClients"
+	PushProx_Scrape_FullMethodName      = "/pushprox.v1.PushProx/Scrape"
+)
+
+// PushProxClient is the client API for PushProx service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// PushProx is served by the proxy, next to its HTTP API.
+type PushProxClient interface {
+	// Connect carries the scrapes for a client and their results. The client
+	// sends a Hello first, then the results of the scrapes it receives.
+	Connect(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[ClientMessage, ScrapeInstruction], error)
+	// ListClients returns the clients known to the proxy.
+	ListClients(ctx context.Context, in *ListClientsRequest, opts ...grpc.CallOption) (*ListClientsResponse, error)
+	// Scrape scrapes a target through its client, as Prometheus would. The
+	// deadline of the call is the scrape timeout.
+	Scrape(ctx context.Context, in *ScrapeRequest, opts ...grpc.CallOption) (*ScrapeResult, error)
+}
+
+type pushProxClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewPushProxClient(cc grpc.ClientConnInterface) PushProxClient {
+	return &pushProxClient{cc}
+}
+
+func (c *pushProxClient) Connect(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[ClientMessage, ScrapeInstruction], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &PushProx_ServiceDesc.Streams[0], PushProx_Connect_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[ClientMessage, ScrapeInstruction]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type PushProx_ConnectClient = grpc.BidiStreamingClient[ClientMessage, ScrapeInstruction]
+
+func (c *pushProxClient) ListClients(ctx context.Context, in *ListClientsRequest, opts ...grpc.CallOption) (*ListClientsResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ListClientsResponse)
+	err := c.cc.Invoke(ctx, PushProx_ListClients_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *pushProxClient) Scrape(ctx context.Context, in *ScrapeRequest, opts ...grpc.CallOption) (*ScrapeResult, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ScrapeResult)
+	err := c.cc.Invoke(ctx, PushProx_Scrape_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// PushProxServer is the server API for PushProx service.
+// All implementations must embed UnimplementedPushProxServer
+// for forward compatibility.
+//
+// PushProx is served by the proxy, next to its HTTP API.
+type PushProxServer interface {
+	// Connect carries the scrapes for a client and their results. The client
+	// sends a Hello first, then the results of the scrapes it receives.
+	Connect(grpc.BidiStreamingServer[ClientMessage, ScrapeInstruction]) error
+	// ListClients returns the clients known to the proxy.
+	ListClients(context.Context, *ListClientsRequest) (*ListClientsResponse, error)
+	// Scrape scrapes a target through its client, as Prometheus would. The
+	// deadline of the call is the scrape timeout.
+	Scrape(context.Context, *ScrapeRequest) (*ScrapeResult, error)
+	mustEmbedUnimplementedPushProxServer()
+}
+
+// UnimplementedPushProxServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedPushProxServer struct{}
+
+func (UnimplementedPushProxServer) Connect(grpc.BidiStreamingServer[ClientMessage, ScrapeInstruction]) error {
+	return status.Errorf(codes.Unimplemented, "method Connect not implemented")
+}
+func (UnimplementedPushProxServer) ListClients(context.Context, *ListClientsRequest) (*ListClientsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListClients not implemented")
+}
+func (UnimplementedPushProxServer) Scrape(context.Context, *ScrapeRequest) (*ScrapeResult, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Scrape not implemented")
+}
+func (UnimplementedPushProxServer) mustEmbedUnimplementedPushProxServer() {}
+func (UnimplementedPushProxServer) testEmbeddedByValue()                  {}
+
+// UnsafePushProxServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to PushProxServer will
+// result in compilation errors.
+type UnsafePushProxServer interface {
+	mustEmbedUnimplementedPushProxServer()
+}
+
+func RegisterPushProxServer(s grpc.ServiceRegistrar, srv PushProxServer) {
+	// If the following call pancis, it indicates UnimplementedPushProxServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&PushProx_ServiceDesc, srv)
+}
+
+func _PushProx_Connect_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(PushProxServer).Connect(&grpc.GenericServerStream[ClientMessage, ScrapeInstruction]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type PushProx_ConnectServer = grpc.BidiStreamingServer[ClientMessage, ScrapeInstruction]
+
+func _PushProx_ListClients_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListClientsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PushProxServer).ListClients(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: PushProx_ListClients_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PushProxServer).ListClients(ctx, req.(*ListClientsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _PushProx_Scrape_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ScrapeRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PushProxServer).Scrape(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: PushProx_Scrape_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PushProxServer).Scrape(ctx, req.(*ScrapeRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// PushProx_ServiceDesc is the grpc.ServiceDesc for PushProx service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var PushProx_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "pushprox.v1.PushProx",
+	HandlerType: (*PushProxServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ListClients",
+			Handler:    _PushProx_ListClients_Handler,
+		},
+		{
+			MethodName: "Scrape",
+			Handler:    _PushProx_Scrape_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Connect",
+			Handler:       _PushProx_Connect_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "pushprox.proto",
+}
@@ -0,0 +1,97 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// auditQueueSize is the number of entries buffered before entries are dropped.
+const auditQueueSize = 1024
+
+// AuditLog writes entries as JSON lines. Entries are written asynchronously,
+// so that a slow disk never delays scrapes; entries which cannot be queued or
+// written are dropped and counted. A nil *AuditLog discards all entries.
+type AuditLog struct {
+	out     io.WriteCloser
+	mu      sync.RWMutex // Guards closed and sending on entries.
+	closed  bool
+	entries chan any
+	done    chan struct{}
+	dropped prometheus.Counter
+	logger  *slog.Logger
+}
+
+// NewAuditLog starts writing entries to out.
+func NewAuditLog(out io.WriteCloser, dropped prometheus.Counter, logger *slog.Logger) *AuditLog {
+	a := &AuditLog{
+		out:     out,
+		entries: make(chan any, auditQueueSize),
+		done:    make(chan struct{}),
+		dropped: dropped,
+		logger:  logger,
+	}
+	go a.run()
+	return a
+}
+
+func (a *AuditLog) run() {
+	defer close(a.done)
+	enc := json.NewEncoder(a.out)
+	for e := range a.entries {
+		if err := enc.Encode(e); err != nil {
+			a.dropped.Inc()
+			a.logger.Warn("Failed to write audit entry", "err", err)
+		}
+	}
+}
+
+// Log queues entry for writing. Entries logged after Close are discarded.
+func (a *AuditLog) Log(entry any) {
+	if a == nil {
+		return
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.closed {
+		return
+	}
+	select {
+	case a.entries <- entry:
+	default:
+		a.dropped.Inc()
+	}
+}
+
+// Close writes all queued entries and closes the underlying writer.
+func (a *AuditLog) Close() error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return nil
+	}
+	a.closed = true
+	close(a.entries)
+	a.mu.Unlock()
+	<-a.done
+	return a.out.Close()
+}
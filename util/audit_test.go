@@ -0,0 +1,61 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package util
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/promslog"
+)
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
+func TestAuditLog(t *testing.T) {
+	buf := &bytes.Buffer{}
+	dropped := prometheus.NewCounter(prometheus.CounterOpts{Name: "dropped"})
+	a := NewAuditLog(nopCloser{buf}, dropped, promslog.NewNopLogger())
+	a.Log(map[string]string{"event": "scrape"})
+	a.Log(func() {}) // Cannot be encoded.
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.String(), "{\"event\":\"scrape\"}\n"; got != want {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+	if v := testutil.ToFloat64(dropped); v != 1 {
+		t.Errorf("Expected 1 dropped entry, got %v", v)
+	}
+
+	// Late entries, e.g. from handlers still in flight, are discarded.
+	a.Log(map[string]string{"event": "late"})
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.String(), "{\"event\":\"scrape\"}\n"; got != want {
+		t.Errorf("Expected no entries after Close, got %q", got)
+	}
+
+	var nilLog *AuditLog
+	nilLog.Log("ignored")
+	if err := nilLog.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
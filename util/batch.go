@@ -0,0 +1,145 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package util
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+)
+
+// BatchVersion is the version of the batch envelope.
+const BatchVersion = "1"
+
+const (
+	batchMediaType = "multipart/mixed"
+	partMediaType  = "application/http"
+)
+
+// isBatch returns whether a body with the given Content-Type is a batch.
+func isBatch(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mediaType == batchMediaType
+}
+
+// BatchWriter writes several scrape requests or responses as a single
+// multipart body, each part holding one HTTP message.
+type BatchWriter struct {
+	mw *multipart.Writer
+}
+
+// NewBatchWriter starts a batch written to w.
+func NewBatchWriter(w io.Writer) *BatchWriter {
+	return &BatchWriter{mw: multipart.NewWriter(w)}
+}
+
+// ContentType returns the Content-Type of the batch, including its version.
+func (b *BatchWriter) ContentType() string {
+	return mime.FormatMediaType(batchMediaType, map[string]string{
+		"boundary": b.mw.Boundary(),
+		"version":  BatchVersion,
+	})
+}
+
+func (b *BatchWriter) createPart() (io.Writer, error) {
+	return b.mw.CreatePart(textproto.MIMEHeader{"Content-Type": {partMediaType}})
+}
+
+// WriteRequest adds a scrape request, as written to the poll response body.
+func (b *BatchWriter) WriteRequest(r *http.Request) error {
+	w, err := b.createPart()
+	if err != nil {
+		return err
+	}
+	return r.WriteProxy(w)
+}
+
+// WriteRaw adds a message which has already been serialized, e.g. a
+// scrape response.
+func (b *BatchWriter) WriteRaw(msg []byte) error {
+	w, err := b.createPart()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(msg)
+	return err
+}
+
+// Close finishes the batch.
+func (b *BatchWriter) Close() error {
+	return b.mw.Close()
+}
+
+// BatchReader reads the messages of a batch.
+type BatchReader struct {
+	mr *multipart.Reader
+}
+
+// NewBatchReader reads the batch in body, with the given Content-Type.
+func NewBatchReader(body io.Reader, contentType string) (*BatchReader, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, fmt.Errorf("parsing batch content type: %w", err)
+	}
+	if mediaType != batchMediaType {
+		return nil, fmt.Errorf("unexpected batch content type %q", mediaType)
+	}
+	if v := params["version"]; v != BatchVersion {
+		return nil, fmt.Errorf("unsupported batch version %q", v)
+	}
+	if params["boundary"] == "" {
+		return nil, fmt.Errorf("batch content type lacks a boundary")
+	}
+	return &BatchReader{mr: multipart.NewReader(body, params["boundary"])}, nil
+}
+
+// next returns the next message, or io.EOF at the end of the batch. Messages
+// are read fully, so that they outlive the part they were read from.
+func (b *BatchReader) next() (*bufio.Reader, error) {
+	part, err := b.mr.NextPart()
+	if err != nil {
+		return nil, err
+	}
+	defer part.Close()
+	if ct := part.Header.Get("Content-Type"); ct != partMediaType {
+		return nil, fmt.Errorf("unexpected batch part content type %q", ct)
+	}
+	msg, err := io.ReadAll(part)
+	if err != nil {
+		return nil, err
+	}
+	return bufio.NewReader(bytes.NewReader(msg)), nil
+}
+
+// NextRequest returns the next scrape request, or io.EOF at the end.
+func (b *BatchReader) NextRequest() (*http.Request, error) {
+	r, err := b.next()
+	if err != nil {
+		return nil, err
+	}
+	return http.ReadRequest(r)
+}
+
+// NextResponse returns the next scrape response, or io.EOF at the end.
+func (b *BatchReader) NextResponse() (*http.Response, error) {
+	r, err := b.next()
+	if err != nil {
+		return nil, err
+	}
+	return http.ReadResponse(r, nil)
+}
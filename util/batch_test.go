@@ -0,0 +1,124 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package util
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestBatch(t *testing.T) {
+	buf := &bytes.Buffer{}
+	bw := NewBatchWriter(buf)
+	for _, u := range []string{"http://a.example.com/metrics", "http://b.example.com/metrics"} {
+		r, err := http.NewRequest(http.MethodGet, u, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := bw.WriteRequest(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := bw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !isBatch(bw.ContentType()) {
+		t.Fatalf("Expected %q to be a batch", bw.ContentType())
+	}
+
+	br, err := NewBatchReader(buf, bw.ContentType())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hosts []string
+	for {
+		r, err := br.NextRequest()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		hosts = append(hosts, r.URL.Hostname())
+	}
+	if got := strings.Join(hosts, ","); got != "a.example.com,b.example.com" {
+		t.Errorf("Expected requests for a and b, got %s", got)
+	}
+}
+
+func TestBatchResponses(t *testing.T) {
+	buf := &bytes.Buffer{}
+	bw := NewBatchWriter(buf)
+	for _, body := range []string{"a 1\n", "b 2\n"} {
+		resp := &http.Response{
+			StatusCode:    http.StatusOK,
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        http.Header{},
+			Body:          io.NopCloser(strings.NewReader(body)),
+			ContentLength: int64(len(body)),
+		}
+		msg := &bytes.Buffer{}
+		if err := resp.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+		if err := bw.WriteRaw(msg.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bw.Close()
+
+	br, err := NewBatchReader(buf, bw.ContentType())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var bodies []string
+	var resps []*http.Response
+	for {
+		resp, err := br.NextResponse()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		resps = append(resps, resp)
+	}
+	// Responses stay readable after moving on to the next one.
+	for _, resp := range resps {
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bodies = append(bodies, string(body))
+	}
+	if got := strings.Join(bodies, ""); got != "a 1\nb 2\n" {
+		t.Errorf("Unexpected bodies %q", got)
+	}
+}
+
+func TestBatchVersion(t *testing.T) {
+	for _, ct := range []string{
+		"multipart/mixed; boundary=x; version=2",
+		"multipart/mixed; boundary=x",
+		"text/plain",
+	} {
+		if _, err := NewBatchReader(strings.NewReader(""), ct); err == nil {
+			t.Errorf("Expected %q to be rejected", ct)
+		}
+	}
+}
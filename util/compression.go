@@ -0,0 +1,114 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package util
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Content-Encodings of compressed scrape results. The capabilities to push
+// results compressed with them have the same names.
+const (
+	EncodingGzip = "gzip"
+	EncodingZstd = "zstd"
+)
+
+// IsSupportedEncoding returns whether results compressed with encoding can
+// be decompressed.
+func IsSupportedEncoding(encoding string) bool {
+	return encoding == EncodingGzip || encoding == EncodingZstd
+}
+
+func newEncoder(w io.Writer, encoding string) (io.WriteCloser, error) {
+	switch encoding {
+	case EncodingGzip:
+		return gzip.NewWriter(w), nil
+	case EncodingZstd:
+		return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+	}
+	return nil, fmt.Errorf("unsupported encoding %q", encoding)
+}
+
+// Compress returns body compressed with encoding, which is compressed as it
+// is read. Once body is read to the end, done is called, if not nil, with
+// the number of bytes read from body and returned compressed.
+func Compress(body io.ReadCloser, encoding string, done func(in, out int64)) (io.ReadCloser, error) {
+	pr, pw := io.Pipe()
+	out := &countingWriter{w: pw}
+	enc, err := newEncoder(out, encoding)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		in, err := io.Copy(enc, body)
+		if cerr := enc.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil && done != nil {
+			done(in, out.n)
+		}
+		pw.CloseWithError(err)
+	}()
+	return &codecBody{Reader: pr, closers: []io.Closer{pr, body}}, nil
+}
+
+// Decompress returns body decompressed from encoding.
+func Decompress(body io.ReadCloser, encoding string) (io.ReadCloser, error) {
+	switch encoding {
+	case EncodingGzip:
+		r, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, err
+		}
+		return &codecBody{Reader: r, closers: []io.Closer{r, body}}, nil
+	case EncodingZstd:
+		r, err := zstd.NewReader(body, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return &codecBody{Reader: r, closers: []io.Closer{r.IOReadCloser(), body}}, nil
+	}
+	return nil, fmt.Errorf("unsupported encoding %q", encoding)
+}
+
+// codecBody reads through a compressor or decompressor, closing it along
+// with the underlying body.
+type codecBody struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (b *codecBody) Close() error {
+	var err error
+	for _, c := range b.closers {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
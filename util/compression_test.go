@@ -0,0 +1,63 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package util
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestCompression(t *testing.T) {
+	metrics := strings.Repeat("http_requests_total{code=\"200\"} 1\n", 1000)
+	for _, encoding := range []string{EncodingGzip, EncodingZstd} {
+		t.Run(encoding, func(t *testing.T) {
+			counted := make(chan [2]int64, 1)
+			compressed, err := Compress(io.NopCloser(strings.NewReader(metrics)), encoding, func(in, out int64) {
+				counted <- [2]int64{in, out}
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			raw, err := io.ReadAll(compressed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n := <-counted; n[0] != int64(len(metrics)) || n[1] != int64(len(raw)) || n[1] >= n[0] {
+				t.Errorf("Expected %d bytes compressed to %d, got %v", len(metrics), len(raw), n)
+			}
+
+			decompressed, err := Decompress(io.NopCloser(strings.NewReader(string(raw))), encoding)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer decompressed.Close()
+			got, err := io.ReadAll(decompressed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != metrics {
+				t.Errorf("Expected the metrics back, got %d bytes", len(got))
+			}
+		})
+	}
+}
+
+func TestUnsupportedEncoding(t *testing.T) {
+	if IsSupportedEncoding("br") {
+		t.Error("Expected br not to be supported")
+	}
+	if _, err := Decompress(io.NopCloser(strings.NewReader("")), "br"); err == nil {
+		t.Error("Expected an error for an unsupported encoding")
+	}
+}
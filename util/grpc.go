@@ -0,0 +1,115 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package util
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	"github.com/prometheus-community/pushprox/pushproxpb"
+)
+
+// gRPC metadata set by the proxy in the trailer of a Connect call it turned
+// down, the counterparts of redirects and ReconnectHeader.
+const (
+	RedirectMetadata  = "pushprox-redirect"
+	ReconnectMetadata = "pushprox-reconnect"
+)
+
+// HeadersToProto converts HTTP headers, sorted by name.
+func HeadersToProto(h http.Header) []*pushproxpb.Header {
+	headers := make([]*pushproxpb.Header, 0, len(h))
+	for name, values := range h {
+		headers = append(headers, &pushproxpb.Header{Name: name, Values: values})
+	}
+	sort.Slice(headers, func(i, j int) bool { return headers[i].Name < headers[j].Name })
+	return headers
+}
+
+// HeadersFromProto converts headers to HTTP headers.
+func HeadersFromProto(headers []*pushproxpb.Header) http.Header {
+	h := make(http.Header, len(headers))
+	for _, header := range headers {
+		for _, v := range header.GetValues() {
+			h.Add(header.GetName(), v)
+		}
+	}
+	return h
+}
+
+// NewScrapeInstruction converts a scrape for a client, which has to be
+// completed within timeout.
+func NewScrapeInstruction(r *http.Request, timeout time.Duration) *pushproxpb.ScrapeInstruction {
+	return &pushproxpb.ScrapeInstruction{
+		Id:      r.Header.Get("Id"),
+		Method:  r.Method,
+		Url:     r.URL.String(),
+		Headers: HeadersToProto(r.Header),
+		Timeout: durationpb.New(timeout),
+	}
+}
+
+// ReadScrapeInstruction converts a scrape received by a client, returning
+// the deadline to complete it by.
+func ReadScrapeInstruction(ctx context.Context, s *pushproxpb.ScrapeInstruction) (*http.Request, time.Time, error) {
+	method := s.GetMethod()
+	if method == "" {
+		method = http.MethodGet
+	}
+	r, err := http.NewRequestWithContext(ctx, method, s.GetUrl(), nil)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	r.Header = HeadersFromProto(s.GetHeaders())
+	r.Header.Set("Id", s.GetId())
+	return r, time.Now().Add(s.GetTimeout().AsDuration()), nil
+}
+
+// NewScrapeResult converts the result of a scrape, reading its body.
+func NewScrapeResult(resp *http.Response) (*pushproxpb.ScrapeResult, error) {
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return &pushproxpb.ScrapeResult{
+		Id:         resp.Header.Get("Id"),
+		StatusCode: int32(resp.StatusCode),
+		Headers:    HeadersToProto(resp.Header),
+		Body:       body,
+	}, nil
+}
+
+// ReadScrapeResult converts the result of a scrape.
+func ReadScrapeResult(s *pushproxpb.ScrapeResult) *http.Response {
+	header := HeadersFromProto(s.GetHeaders())
+	if id := s.GetId(); id != "" {
+		header.Set("Id", id)
+	}
+	return &http.Response{
+		Status:        strconv.Itoa(int(s.GetStatusCode())) + " " + http.StatusText(int(s.GetStatusCode())),
+		StatusCode:    int(s.GetStatusCode()),
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(s.GetBody())),
+		ContentLength: int64(len(s.GetBody())),
+	}
+}
@@ -0,0 +1,49 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package util
+
+import "strings"
+
+// MQTT topics of a client, below <prefix>/<fqdn>/. Scrapes and results are
+// sent in HTTP wire format, as on streams.
+const (
+	// MQTTRequestTopic carries scrapes from the proxy to the client.
+	MQTTRequestTopic = "req"
+	// MQTTResultTopic carries results from the client to the proxy.
+	MQTTResultTopic = "resp"
+	// MQTTStatusTopic holds the retained status of the client, MQTTOnline
+	// or MQTTOffline, the latter being its last will.
+	MQTTStatusTopic = "status"
+
+	MQTTOnline  = "online"
+	MQTTOffline = "offline"
+)
+
+// MQTTQoS is the quality of service of all messages.
+const MQTTQoS = 1
+
+// MQTTTopic returns a topic of the client fqdn.
+func MQTTTopic(prefix, fqdn, topic string) string {
+	return prefix + "/" + fqdn + "/" + topic
+}
+
+// ParseMQTTTopic returns the client and topic of one of the topics below
+// prefix.
+func ParseMQTTTopic(prefix, topic string) (fqdn, name string, ok bool) {
+	rest, ok := strings.CutPrefix(topic, prefix+"/")
+	if !ok {
+		return "", "", false
+	}
+	fqdn, name, ok = strings.Cut(rest, "/")
+	return fqdn, name, ok && fqdn != ""
+}
@@ -0,0 +1,323 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package util
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Protocol versions. Version 1 is the protocol of clients which don't send a
+// version: the FQDN as the poll body, a single scrape request as the poll
+// response and a single scrape response as the push body. Version 2 adds the
+// negotiation of capabilities.
+const (
+	ProtocolVersion1 = 1
+	ProtocolVersion2 = 2
+
+	// ProtocolVersion is the latest version.
+	ProtocolVersion = ProtocolVersion2
+)
+
+const (
+	// ProtocolVersionHeader carries the protocol version spoken by the
+	// client on polls and pushes, and the version picked by the proxy on
+	// poll responses.
+	ProtocolVersionHeader = "X-Pushprox-Protocol-Version"
+	// CapabilitiesHeader carries the capabilities offered by the client on
+	// polls, and the ones accepted by the proxy on poll responses.
+	CapabilitiesHeader = "X-Pushprox-Capabilities"
+)
+
+// Capabilities which can be negotiated.
+const (
+	// CapabilityBatch exchanges up to the given number of scrape requests in
+	// a poll response, and of scrape responses in a push.
+	CapabilityBatch = "batch"
+	// CapabilityScrapeLimit advertises that the client accepts at most the
+	// given number of scrapes at once.
+	CapabilityScrapeLimit = "scrape-limit"
+	// CapabilityGzip and CapabilityZstd accept scrape results compressed
+	// with the Content-Encoding of the same name.
+	CapabilityGzip = EncodingGzip
+	CapabilityZstd = EncodingZstd
+)
+
+// Capabilities maps the names of capabilities to their parameter, or 0 if
+// they have none.
+type Capabilities map[string]int
+
+// ParseCapabilities parses a header such as "batch=10, scrape-limit=5".
+// Malformed entries are ignored, so that future capabilities can use other
+// parameters.
+func ParseCapabilities(s string) Capabilities {
+	c := Capabilities{}
+	for _, entry := range strings.Split(s, ",") {
+		name, param, hasParam := strings.Cut(strings.TrimSpace(entry), "=")
+		if name == "" {
+			continue
+		}
+		n := 0
+		if hasParam {
+			var err error
+			if n, err = strconv.Atoi(param); err != nil || n < 0 {
+				continue
+			}
+		}
+		c[name] = n
+	}
+	return c
+}
+
+// String formats the capabilities as a header value.
+func (c Capabilities) String() string {
+	entries := make([]string, 0, len(c))
+	for name, n := range c {
+		if n != 0 {
+			name += "=" + strconv.Itoa(n)
+		}
+		entries = append(entries, name)
+	}
+	slices.Sort(entries)
+	return strings.Join(entries, ", ")
+}
+
+// Has returns whether a capability is present.
+func (c Capabilities) Has(name string) bool {
+	_, ok := c[name]
+	return ok
+}
+
+// Poll is a client asking the proxy for scrapes.
+type Poll struct {
+	FQDN         string
+	Version      int
+	Capabilities Capabilities
+}
+
+// NewPollRequest encodes a poll. Version 1 proxies only see the FQDN.
+func NewPollRequest(ctx context.Context, url string, p Poll) (*http.Request, error) {
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, url, strings.NewReader(p.FQDN))
+	if err != nil {
+		return nil, err
+	}
+	if p.Version > ProtocolVersion1 {
+		r.Header.Set(ProtocolVersionHeader, strconv.Itoa(p.Version))
+		if len(p.Capabilities) > 0 {
+			r.Header.Set(CapabilitiesHeader, p.Capabilities.String())
+		}
+	}
+	return r, nil
+}
+
+// DecodePoll decodes a poll of any version.
+func DecodePoll(r *http.Request) (Poll, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return Poll{}, err
+	}
+	p := Poll{
+		FQDN:         strings.TrimSpace(string(body)),
+		Version:      headerVersion(r.Header),
+		Capabilities: Capabilities{},
+	}
+	if p.Version > ProtocolVersion1 {
+		p.Capabilities = ParseCapabilities(r.Header.Get(CapabilitiesHeader))
+	}
+	return p, nil
+}
+
+func headerVersion(h http.Header) int {
+	v, err := strconv.Atoi(h.Get(ProtocolVersionHeader))
+	if err != nil || v < ProtocolVersion1 {
+		return ProtocolVersion1
+	}
+	return v
+}
+
+// Negotiate returns the protocol version and capabilities used for a poll,
+// given the capabilities supported by the proxy. Parameters are limited to
+// the lower one of both sides, unless one side has none.
+func Negotiate(p Poll, supported Capabilities) (int, Capabilities) {
+	version := min(p.Version, ProtocolVersion)
+	accepted := Capabilities{}
+	if version < ProtocolVersion2 {
+		return version, accepted
+	}
+	for name, n := range p.Capabilities {
+		limit, ok := supported[name]
+		if !ok {
+			continue
+		}
+		if n == 0 || (limit != 0 && limit < n) {
+			n = limit
+		}
+		accepted[name] = n
+	}
+	return version, accepted
+}
+
+// PollResponse is the proxy's answer to a poll.
+type PollResponse struct {
+	Version      int
+	Capabilities Capabilities
+	Requests     []*http.Request
+}
+
+// WritePollResponse writes the scrape requests for a poll. Several requests
+// are only written if the batch capability was accepted.
+func WritePollResponse(w http.ResponseWriter, resp PollResponse) error {
+	if len(resp.Requests) == 0 {
+		return errors.New("poll response without scrape requests")
+	}
+	if resp.Version > ProtocolVersion1 {
+		w.Header().Set(ProtocolVersionHeader, strconv.Itoa(resp.Version))
+		w.Header().Set(CapabilitiesHeader, resp.Capabilities.String())
+	}
+	if !resp.Capabilities.Has(CapabilityBatch) {
+		if len(resp.Requests) > 1 {
+			return errors.New("several scrape requests without the batch capability")
+		}
+		return resp.Requests[0].WriteProxy(w)
+	}
+	bw := NewBatchWriter(w)
+	w.Header().Set("Content-Type", bw.ContentType())
+	for _, r := range resp.Requests {
+		if err := bw.WriteRequest(r); err != nil {
+			return err
+		}
+	}
+	return bw.Close()
+}
+
+// ReadPollResponse decodes the answer to a poll, from a proxy of any version.
+func ReadPollResponse(resp *http.Response) (PollResponse, error) {
+	pr := PollResponse{
+		Version:      headerVersion(resp.Header),
+		Capabilities: Capabilities{},
+	}
+	if pr.Version > ProtocolVersion1 {
+		pr.Capabilities = ParseCapabilities(resp.Header.Get(CapabilitiesHeader))
+	}
+	if !isBatch(resp.Header.Get("Content-Type")) {
+		r, err := http.ReadRequest(bufio.NewReader(resp.Body))
+		if err != nil {
+			return pr, err
+		}
+		pr.Requests = []*http.Request{r}
+		return pr, nil
+	}
+	br, err := NewBatchReader(resp.Body, resp.Header.Get("Content-Type"))
+	if err != nil {
+		return pr, err
+	}
+	for {
+		r, err := br.NextRequest()
+		if errors.Is(err, io.EOF) {
+			return pr, nil
+		}
+		if err != nil {
+			return pr, err
+		}
+		pr.Requests = append(pr.Requests, r)
+	}
+}
+
+// NewPushRequest encodes scrape responses, serialized with
+// http.Response.Write, for pushing. Several responses require the batch
+// capability.
+func NewPushRequest(ctx context.Context, url string, version int, msgs ...[]byte) (*http.Request, error) {
+	if len(msgs) == 0 {
+		return nil, errors.New("push without scrape responses")
+	}
+	body := &bytes.Buffer{}
+	contentType := ""
+	if len(msgs) == 1 {
+		body.Write(msgs[0])
+	} else {
+		bw := NewBatchWriter(body)
+		for _, msg := range msgs {
+			if err := bw.WriteRaw(msg); err != nil {
+				return nil, err
+			}
+		}
+		if err := bw.Close(); err != nil {
+			return nil, err
+		}
+		contentType = bw.ContentType()
+	}
+	r, err := NewStreamedPushRequest(ctx, url, version, body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		r.Header.Set("Content-Type", contentType)
+	}
+	return r, nil
+}
+
+// NewStreamedPushRequest pushes a single scrape response, serialized with
+// http.Response.Write, which is read from body while the push is sent.
+func NewStreamedPushRequest(ctx context.Context, url string, version int, body io.Reader) (*http.Request, error) {
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, url, body)
+	if err != nil {
+		return nil, err
+	}
+	if version > ProtocolVersion1 {
+		r.Header.Set(ProtocolVersionHeader, strconv.Itoa(version))
+	}
+	return r, nil
+}
+
+// ReadPush decodes the scrape responses of a push of any version. The body
+// of a single response is streamed from the push, see IsStreamedPush, while
+// the responses of a batch are read fully. On errors reading a batch, the
+// responses read before are returned too.
+func ReadPush(r *http.Request) ([]*http.Response, error) {
+	if IsStreamedPush(r) {
+		resp, err := http.ReadResponse(bufio.NewReader(r.Body), nil)
+		if err != nil {
+			return nil, err
+		}
+		return []*http.Response{resp}, nil
+	}
+	br, err := NewBatchReader(r.Body, r.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, err
+	}
+	var resps []*http.Response
+	for {
+		resp, err := br.NextResponse()
+		if errors.Is(err, io.EOF) {
+			return resps, nil
+		}
+		if err != nil {
+			return resps, fmt.Errorf("reading pushed batch: %w", err)
+		}
+		resps = append(resps, resp)
+	}
+}
+
+// IsStreamedPush returns whether the response of a push is read from its body
+// as it arrives, so that the push must not be answered before it was read.
+func IsStreamedPush(r *http.Request) bool {
+	return !isBatch(r.Header.Get("Content-Type"))
+}
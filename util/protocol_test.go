@@ -0,0 +1,101 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package util
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCapabilities(t *testing.T) {
+	c := ParseCapabilities(" batch=10,scrape-limit , bogus=x, =1, future")
+	if got, want := c.String(), "batch=10, future, scrape-limit"; got != want {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+	if !c.Has(CapabilityScrapeLimit) || c.Has("bogus") {
+		t.Errorf("Unexpected capabilities %v", c)
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	supported := Capabilities{CapabilityBatch: 100, CapabilityScrapeLimit: 0}
+	for _, tc := range []struct {
+		poll    Poll
+		version int
+		caps    string
+	}{
+		{Poll{Version: ProtocolVersion1}, ProtocolVersion1, ""},
+		// Version 1 clients cannot offer capabilities.
+		{Poll{Version: ProtocolVersion1, Capabilities: Capabilities{CapabilityBatch: 10}}, ProtocolVersion1, ""},
+		{Poll{Version: ProtocolVersion2, Capabilities: Capabilities{CapabilityBatch: 10, CapabilityScrapeLimit: 5}}, ProtocolVersion2, "batch=10, scrape-limit=5"},
+		{Poll{Version: ProtocolVersion2, Capabilities: Capabilities{CapabilityBatch: 1000, "future": 1}}, ProtocolVersion2, "batch=100"},
+		// Newer clients get the latest version the proxy speaks.
+		{Poll{Version: ProtocolVersion + 1, Capabilities: Capabilities{CapabilityBatch: 0}}, ProtocolVersion, "batch=100"},
+	} {
+		version, caps := Negotiate(tc.poll, supported)
+		if version != tc.version || caps.String() != tc.caps {
+			t.Errorf("Negotiating %+v: expected version %d with %q, got %d with %q", tc.poll, tc.version, tc.caps, version, caps)
+		}
+	}
+}
+
+func TestPollRoundTrip(t *testing.T) {
+	for _, p := range []Poll{
+		{FQDN: "a.example.com", Version: ProtocolVersion1, Capabilities: Capabilities{}},
+		{FQDN: "b.example.com", Version: ProtocolVersion2, Capabilities: Capabilities{CapabilityBatch: 10}},
+	} {
+		r, err := NewPollRequest(context.Background(), "http://proxy/poll", p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := DecodePoll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.FQDN != p.FQDN || got.Version != p.Version || got.Capabilities.String() != p.Capabilities.String() {
+			t.Errorf("Expected %+v, got %+v", p, got)
+		}
+	}
+}
+
+func TestPollResponseRoundTrip(t *testing.T) {
+	request := func() *http.Request {
+		r, _ := http.NewRequest(http.MethodGet, "http://a.example.com/metrics", nil)
+		return r
+	}
+	for _, pr := range []PollResponse{
+		{Version: ProtocolVersion1, Requests: []*http.Request{request()}},
+		{Version: ProtocolVersion2, Capabilities: Capabilities{}, Requests: []*http.Request{request()}},
+		{Version: ProtocolVersion2, Capabilities: Capabilities{CapabilityBatch: 10}, Requests: []*http.Request{request(), request()}},
+	} {
+		w := httptest.NewRecorder()
+		if err := WritePollResponse(w, pr); err != nil {
+			t.Fatal(err)
+		}
+		got, err := ReadPollResponse(w.Result())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Version != pr.Version || got.Capabilities.String() != pr.Capabilities.String() || len(got.Requests) != len(pr.Requests) {
+			t.Errorf("Expected %+v, got %+v", pr, got)
+		}
+	}
+
+	// Several requests can only be sent in a batch.
+	w := httptest.NewRecorder()
+	if err := WritePollResponse(w, PollResponse{Version: ProtocolVersion2, Requests: []*http.Request{request(), request()}}); err == nil {
+		t.Error("Expected several requests without the batch capability to fail")
+	}
+}
@@ -19,6 +19,10 @@ import (
 	"time"
 )
 
+// ReconnectHeader is set by the proxy on poll responses asking the client to
+// poll again right away, e.g. because the proxy is shutting down.
+const ReconnectHeader = "X-Pushprox-Reconnect"
+
 func GetScrapeTimeout(maxScrapeTimeout, defaultScrapeTimeout *time.Duration, h http.Header) time.Duration {
 	timeout := *defaultScrapeTimeout
 	headerTimeout, err := GetHeaderTimeout(h)
@@ -0,0 +1,44 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package util
+
+import (
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SSHScrapeChannel is the type of the channels the proxy opens to a client
+// connected via SSH, one per scrape. The proxy writes the scrape in HTTP wire
+// format and closes its side, the client answers with the result.
+const SSHScrapeChannel = "pushprox-scrape"
+
+// SSHReconnectRequest is a global request the proxy sends before closing the
+// connection of a client, asking it to connect again right away, e.g. because
+// the proxy is shutting down. The counterpart of ReconnectHeader.
+const SSHReconnectRequest = "pushprox-reconnect"
+
+// SSHKeepalive sends a keepalive on conn every interval, closing it once one
+// is not answered within the interval. It returns once conn is closed.
+func SSHKeepalive(conn ssh.Conn, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for range t.C {
+		timeout := time.AfterFunc(interval, func() { conn.Close() })
+		_, _, err := conn.SendRequest("keepalive@openssh.com", true, nil)
+		timeout.Stop()
+		if err != nil {
+			return
+		}
+	}
+}
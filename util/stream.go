@@ -0,0 +1,209 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package util
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// FQDNHeader carries the FQDN of a client opening a stream, as the request
+// body is taken by the stream itself.
+const FQDNHeader = "X-Pushprox-Fqdn"
+
+// Types of stream frames.
+const (
+	// FrameScrapeRequest carries a scrape request, as written by
+	// http.Request.WriteProxy, from the proxy to the client.
+	FrameScrapeRequest byte = 1
+	// FrameScrapeResponse carries a scrape response, as written by
+	// http.Response.Write, from the client to the proxy.
+	FrameScrapeResponse byte = 2
+)
+
+// maxFrameSize is the largest frame the header can describe.
+const maxFrameSize = 1<<32 - 1
+
+// DefaultFrameReadLimit is the largest frame a FrameReader accepts by default.
+const DefaultFrameReadLimit = 16 << 20
+
+// A frame is a type byte, followed by the length of the payload as a 32-bit
+// big endian integer and the payload.
+const frameHeaderSize = 5
+
+// FrameWriter writes frames to a stream. It is safe for concurrent use.
+type FrameWriter struct {
+	mu    sync.Mutex
+	w     io.Writer
+	flush func() error
+}
+
+// NewFrameWriter writes frames to w, calling flush, if not nil, after each.
+func NewFrameWriter(w io.Writer, flush func() error) *FrameWriter {
+	return &FrameWriter{w: w, flush: flush}
+}
+
+// WriteFrame writes a frame of the given type.
+func (f *FrameWriter) WriteFrame(typ byte, payload []byte) error {
+	if int64(len(payload)) > maxFrameSize {
+		return fmt.Errorf("frame of %d bytes exceeds the maximum of %d", len(payload), maxFrameSize)
+	}
+	var header [frameHeaderSize]byte
+	header[0] = typ
+	binary.BigEndian.PutUint32(header[1:], uint32(len(payload)))
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, err := f.w.Write(header[:]); err != nil {
+		return err
+	}
+	if _, err := f.w.Write(payload); err != nil {
+		return err
+	}
+	if f.flush != nil {
+		return f.flush()
+	}
+	return nil
+}
+
+// FrameReader reads frames from a stream.
+type FrameReader struct {
+	r     *bufio.Reader
+	limit int64
+	// Payload of the last frame returned by NextFrame.
+	payload *framePayload
+}
+
+// NewFrameReader reads frames from r.
+func NewFrameReader(r io.Reader) *FrameReader {
+	return &FrameReader{r: bufio.NewReader(r), limit: DefaultFrameReadLimit}
+}
+
+// SetReadLimit sets the largest frame accepted, like
+// websocket.Conn.SetReadLimit.
+func (f *FrameReader) SetReadLimit(limit int64) {
+	f.limit = limit
+}
+
+// NextFrame returns the type and payload of the next frame, or io.EOF at the
+// end of the stream. The payload is read from the stream, so it is only valid
+// until the next call; whatever is left of it is then skipped.
+func (f *FrameReader) NextFrame() (byte, io.Reader, error) {
+	if f.payload != nil {
+		if _, err := io.Copy(io.Discard, f.payload); err != nil {
+			return 0, nil, err
+		}
+		f.payload = nil
+	}
+	var header [frameHeaderSize]byte
+	if _, err := io.ReadFull(f.r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	n := int64(binary.BigEndian.Uint32(header[1:]))
+	if n > f.limit {
+		return 0, nil, fmt.Errorf("frame of %d bytes exceeds the maximum of %d", n, f.limit)
+	}
+	f.payload = &framePayload{r: f.r, n: n}
+	return header[0], f.payload, nil
+}
+
+// ReadFrame returns the next frame, or io.EOF at the end of the stream.
+func (f *FrameReader) ReadFrame() (byte, []byte, error) {
+	typ, r, err := f.NextFrame()
+	if err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, f.payload.n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return typ, payload, nil
+}
+
+// framePayload reads the payload of a frame, failing if the stream ends
+// before it does.
+type framePayload struct {
+	r io.Reader
+	n int64 // Bytes left.
+}
+
+func (p *framePayload) Read(b []byte) (int, error) {
+	if p.n <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(b)) > p.n {
+		b = b[:p.n]
+	}
+	n, err := p.r.Read(b)
+	p.n -= int64(n)
+	if errors.Is(err, io.EOF) && p.n > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// NewStreamRequest opens a stream for a client, sending the frames written
+// to body.
+func NewStreamRequest(ctx context.Context, url string, p Poll, body io.Reader) (*http.Request, error) {
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, url, body)
+	if err != nil {
+		return nil, err
+	}
+	r.Header = StreamHeader(p)
+	return r, nil
+}
+
+// StreamHeader returns the headers opening a stream for a client.
+func StreamHeader(p Poll) http.Header {
+	h := http.Header{}
+	h.Set(FQDNHeader, p.FQDN)
+	h.Set(ProtocolVersionHeader, strconv.Itoa(p.Version))
+	if len(p.Capabilities) > 0 {
+		h.Set(CapabilitiesHeader, p.Capabilities.String())
+	}
+	return h
+}
+
+// DecodeStream decodes the client side of a stream being opened.
+func DecodeStream(r *http.Request) (Poll, error) {
+	p := Poll{
+		FQDN:         strings.TrimSpace(r.Header.Get(FQDNHeader)),
+		Version:      headerVersion(r.Header),
+		Capabilities: ParseCapabilities(r.Header.Get(CapabilitiesHeader)),
+	}
+	if p.FQDN == "" {
+		return p, errors.New("stream without FQDN")
+	}
+	return p, nil
+}
+
+// WriteStreamHeader writes the version and capabilities accepted by the proxy
+// for a stream.
+func WriteStreamHeader(w http.ResponseWriter, version int, caps Capabilities) {
+	w.Header().Set(ProtocolVersionHeader, strconv.Itoa(version))
+	w.Header().Set(CapabilitiesHeader, caps.String())
+	w.WriteHeader(http.StatusOK)
+}
+
+// ReadStreamHeader returns the version and capabilities accepted by the proxy
+// for a stream.
+func ReadStreamHeader(resp *http.Response) (int, Capabilities) {
+	return headerVersion(resp.Header), ParseCapabilities(resp.Header.Get(CapabilitiesHeader))
+}
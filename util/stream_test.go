@@ -0,0 +1,80 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package util
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestFrames(t *testing.T) {
+	buf := &bytes.Buffer{}
+	fw := NewFrameWriter(buf, nil)
+	if err := fw.WriteFrame(FrameScrapeRequest, []byte("request")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fw.WriteFrame(FrameScrapeResponse, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	fr := NewFrameReader(bytes.NewReader(buf.Bytes()))
+	typ, payload, err := fr.ReadFrame()
+	if err != nil || typ != FrameScrapeRequest || string(payload) != "request" {
+		t.Errorf("Unexpected frame %d %q: %v", typ, payload, err)
+	}
+	typ, payload, err = fr.ReadFrame()
+	if err != nil || typ != FrameScrapeResponse || len(payload) != 0 {
+		t.Errorf("Unexpected frame %d %q: %v", typ, payload, err)
+	}
+	if _, _, err := fr.ReadFrame(); !errors.Is(err, io.EOF) {
+		t.Errorf("Expected EOF, got %v", err)
+	}
+
+	// A frame cut short.
+	fr = NewFrameReader(bytes.NewReader(buf.Bytes()[:8]))
+	if _, _, err := fr.ReadFrame(); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("Expected unexpected EOF, got %v", err)
+	}
+}
+
+func TestNextFrame(t *testing.T) {
+	buf := &bytes.Buffer{}
+	fw := NewFrameWriter(buf, nil)
+	fw.WriteFrame(FrameScrapeResponse, []byte("first result"))
+	fw.WriteFrame(FrameScrapeResponse, []byte("second"))
+	fw.WriteFrame(FrameScrapeResponse, []byte("a result too large to read"))
+
+	fr := NewFrameReader(bytes.NewReader(buf.Bytes()))
+	fr.SetReadLimit(int64(len("first result")))
+	_, r, err := fr.NextFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only read part of it, the rest is skipped.
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(r, b); err != nil || string(b) != "first" {
+		t.Fatalf("Unexpected start of payload %q: %v", b, err)
+	}
+	_, r, err = fr.NextFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := io.ReadAll(r); string(b) != "second" {
+		t.Errorf("Expected the second frame, got %q", b)
+	}
+	if _, _, err := fr.NextFrame(); err == nil {
+		t.Error("Expected a frame over the limit to fail")
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package util
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// writeTimeout bounds how long writing a message to a WebSocket may take.
+const writeTimeout = 30 * time.Second
+
+// WebSocketConn exchanges frames as binary WebSocket messages, the first byte
+// being the frame type. It keeps the connection alive with pings, and
+// considers it dead once nothing, not even a pong, was received for twice the
+// ping interval.
+type WebSocketConn struct {
+	conn         *websocket.Conn
+	pingInterval time.Duration
+	mu           sync.Mutex
+	done         chan struct{}
+	closeOnce    sync.Once
+}
+
+// NewWebSocketConn starts pinging the peer of conn every pingInterval. Frames
+// larger than readLimit fail the connection.
+func NewWebSocketConn(conn *websocket.Conn, pingInterval time.Duration, readLimit int64) *WebSocketConn {
+	c := &WebSocketConn{conn: conn, pingInterval: pingInterval, done: make(chan struct{})}
+	// Plus the frame type.
+	conn.SetReadLimit(readLimit + 1)
+	c.extendDeadline()
+	conn.SetPongHandler(func(string) error {
+		c.extendDeadline()
+		return nil
+	})
+	go c.ping()
+	return c
+}
+
+func (c *WebSocketConn) extendDeadline() {
+	c.conn.SetReadDeadline(time.Now().Add(2 * c.pingInterval)) //nolint:errcheck
+}
+
+func (c *WebSocketConn) ping() {
+	t := time.NewTicker(c.pingInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-t.C:
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeTimeout)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// WriteFrame sends a frame. It is safe for concurrent use.
+func (c *WebSocketConn) WriteFrame(typ byte, payload []byte) error {
+	msg := make([]byte, 0, len(payload)+1)
+	msg = append(msg, typ)
+	msg = append(msg, payload...)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(writeTimeout)) //nolint:errcheck
+	return c.conn.WriteMessage(websocket.BinaryMessage, msg)
+}
+
+// ReadFrame returns the next frame, or io.EOF once the peer closed the
+// connection.
+func (c *WebSocketConn) ReadFrame() (byte, []byte, error) {
+	for {
+		typ, msg, err := c.conn.ReadMessage()
+		if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+			return 0, nil, io.EOF
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+		if typ != websocket.BinaryMessage || len(msg) == 0 {
+			continue
+		}
+		c.extendDeadline()
+		return msg[0], msg[1:], nil
+	}
+}
+
+// NextFrame returns the type and payload of the next frame, or io.EOF once
+// the peer closed the connection. The payload is read from the connection, so
+// it is only valid until the next call.
+func (c *WebSocketConn) NextFrame() (byte, io.Reader, error) {
+	for {
+		typ, r, err := c.conn.NextReader()
+		if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+			return 0, nil, io.EOF
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+		if typ != websocket.BinaryMessage {
+			continue
+		}
+		var frameType [1]byte
+		if _, err := io.ReadFull(r, frameType[:]); errors.Is(err, io.EOF) {
+			continue
+		} else if err != nil {
+			return 0, nil, err
+		}
+		c.extendDeadline()
+		return frameType[0], r, nil
+	}
+}
+
+// Close tells the peer we are going away and closes the connection.
+func (c *WebSocketConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.done)
+		msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "")
+		c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second)) //nolint:errcheck
+		err = c.conn.Close()
+	})
+	if errors.Is(err, io.EOF) {
+		return nil
+	}
+	return err
+}